@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tiborvass/cosmos/policy"
+	"github.com/tiborvass/cosmos/snapshot"
+)
+
+// approvalTimeout is how long a tool call waits for the user before being refused.
+const approvalTimeout = 5 * time.Minute
+
+// tty is the user's terminal while the agent runs in it, nil without a terminal.
+var tty *terminal
+
+// approve asks the user whether a tool call that the policy asks about may run.
+// Without an answer, the call is refused.
+func approve(ctx context.Context, req policy.ApprovalRequest) policy.Approval {
+	ctx, span := tracer.Start(ctx, "approve")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, approvalTimeout)
+	defer cancel()
+
+	call := snapshot.NewToolCall(req.Tool, req.Input).String()
+	fmt.Fprintln(logFile, "approval requested for", call, req.Reason)
+	notify(ctx, "Approval needed", call)
+
+	var a policy.Approval
+	switch {
+	case tty != nil:
+		a = approveInTerminal(ctx, req)
+	case runtime.GOOS == "darwin":
+		a = approveInDialog(ctx, req, call)
+	default:
+		a = policy.Approval{Reason: "it needs approval and there is no terminal to ask for it"}
+	}
+	fmt.Fprintln(logFile, "approval for", call, ":", a.Allow, a.Reason)
+	return a
+}
+
+func approveInTerminal(ctx context.Context, req policy.ApprovalRequest) policy.Approval {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\x1b[1mcosmos: the agent wants to use %s\x1b[0m\n", req.Tool)
+	if req.Reason != "" {
+		fmt.Fprintf(&sb, "Policy: %s\n", req.Reason)
+	}
+	sb.WriteString("\n" + formatInput(req.Input, 30) + "\n")
+	answer, err := tty.Prompt(ctx, sb.String(), "Allow? [y/N, or type why not] ")
+	if err != nil {
+		return policy.Approval{Reason: refusalReason(err)}
+	}
+	switch answer = strings.TrimSpace(answer); strings.ToLower(answer) {
+	case "y", "yes":
+		return policy.Approval{Allow: true}
+	case "", "n", "no":
+		return policy.Approval{Reason: "the user refused it"}
+	default:
+		return policy.Approval{Reason: "the user refused it: " + answer}
+	}
+}
+
+func approveInDialog(ctx context.Context, req policy.ApprovalRequest, call string) policy.Approval {
+	text := fmt.Sprintf("The agent wants to use %s", call)
+	if req.Reason != "" {
+		text += "\n\nPolicy: " + req.Reason
+	}
+	script := fmt.Sprintf(`display dialog %s with title "cosmos" buttons {"Refuse", "Allow"} default button "Refuse"`, strconv.Quote(text))
+	out, err := exec.CommandContext(ctx, "osascript", "-e", script).Output()
+	if err != nil {
+		// osascript fails when the dialog is cancelled.
+		return policy.Approval{Reason: refusalReason(err)}
+	}
+	if strings.Contains(string(out), "Allow") {
+		return policy.Approval{Allow: true}
+	}
+	return policy.Approval{Reason: "the user refused it"}
+}
+
+func refusalReason(err error) string {
+	if err == context.DeadlineExceeded {
+		return fmt.Sprintf("nobody approved it within %v", approvalTimeout)
+	}
+	return "the user refused it"
+}
+
+// formatInput indents the JSON input of a tool call, cut to n lines.
+func formatInput(input json.RawMessage, n int) string {
+	var buf bytes.Buffer
+	if json.Indent(&buf, input, "", "  ") != nil {
+		return string(input)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) > n {
+		lines = append(lines[:n], fmt.Sprintf("... (%d more lines)", len(lines)-n))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// notify shows a desktop notification, if the platform has a way to.
+func notify(ctx context.Context, title, text string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "osascript", "-e", fmt.Sprintf("display notification %s with title %s", strconv.Quote(text), strconv.Quote("cosmos: "+title)))
+	case "linux":
+		if _, err := exec.LookPath("notify-send"); err != nil {
+			return
+		}
+		cmd = exec.CommandContext(ctx, "notify-send", "cosmos: "+title, text)
+	default:
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(logFile, "notify:", err)
+		return
+	}
+	go cmd.Wait()
+}
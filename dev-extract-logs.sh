@@ -1,16 +1,25 @@
 #!/usr/bin/env bash
 
-# Extract proxy logs from container (running or stopped)
+# Extract the proxy logs of a session (running or stopped): ./dev-extract-logs.sh [<session>]
 
 echo "=== Extracting Cosmos Proxy Logs ==="
 
-# Find container (running or stopped)
-CONTAINER_ID=$(docker ps -aq --filter "ancestor=cosmos" | head -1)
+# Find the container of the session, or the only one
+if [ -n "$1" ]; then
+    CONTAINER_ID=$(docker ps -aq --filter "label=cosmos.session=$1")
+else
+    CONTAINER_ID=$(docker ps -aq --filter "label=cosmos.session")
+fi
 
 if [ -z "$CONTAINER_ID" ]; then
     echo "Error: No cosmos container found (running or stopped)"
     exit 1
 fi
+if [ "$(echo "$CONTAINER_ID" | wc -l)" -gt 1 ]; then
+    echo "Error: Several sessions have a container, pick one:"
+    go run . ps -a
+    exit 1
+fi
 
 # Check if container is running
 if docker ps -q --filter "id=$CONTAINER_ID" | grep -q .; then
@@ -21,7 +30,7 @@ fi
 
 # Copy logs to host
 OUTPUT_FILE="cosmos-proxy-$(date +%Y%m%d-%H%M%S).log"
-docker cp "$CONTAINER_ID:/tmp/cosmos-proxy.log" "$OUTPUT_FILE" 2>/dev/null
+docker cp "$CONTAINER_ID:/cosmos/proxy.log" "$OUTPUT_FILE" 2>/dev/null
 
 if [ $? -eq 0 ]; then
     echo "Logs extracted to: $OUTPUT_FILE"
@@ -30,4 +39,4 @@ if [ $? -eq 0 ]; then
     head -20 "$OUTPUT_FILE"
 else
     echo "No logs found in container"
-fi
\ No newline at end of file
+fi
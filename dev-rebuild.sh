@@ -6,7 +6,7 @@ echo "=== Rebuilding Cosmos ==="
 
 # Stop any running containers
 echo "Stopping any running cosmos containers..."
-docker ps -q --filter "ancestor=cosmos" | xargs -r docker stop
+docker ps -q --filter "label=cosmos.session" | xargs -r docker stop
 
 # Rebuild
 echo "Building new image..."
@@ -17,4 +17,4 @@ echo "✓ Build complete"
 echo ""
 echo "To test:"
 echo "  Terminal 1: ./dev-tail-logs.sh"
-echo "  Terminal 2: go run main.go claude"
\ No newline at end of file
+echo "  Terminal 2: go run . claude"
\ No newline at end of file
@@ -1,16 +1,31 @@
 #!/usr/bin/env bash
 
-# Tail the proxy logs from inside the running container
+# Tail the proxy logs of a running session: ./dev-tail-logs.sh [--clear] [<session>]
 
 echo "=== Tailing Cosmos Proxy Logs ==="
 
-# Find the running cosmos container
-CONTAINER_ID=$(docker ps -q --filter "ancestor=cosmos" | head -1)
+CLEAR=
+if [ "$1" = "--clear" ]; then
+    CLEAR=1
+    shift
+fi
+
+# Find the running container of the session, or the only one running
+if [ -n "$1" ]; then
+    CONTAINER_ID=$(docker ps -q --filter "label=cosmos.session=$1")
+else
+    CONTAINER_ID=$(docker ps -q --filter "label=cosmos.session")
+fi
 
 if [ -z "$CONTAINER_ID" ]; then
     echo "Error: No running cosmos container found"
     echo ""
-    echo "Start cosmos first with: go run main.go claude"
+    echo "Start cosmos first with: go run . claude"
+    exit 1
+fi
+if [ "$(echo "$CONTAINER_ID" | wc -l)" -gt 1 ]; then
+    echo "Error: Several sessions are running, pick one:"
+    go run . ps
     exit 1
 fi
 
@@ -19,7 +34,7 @@ echo "Log file: /cosmos/proxy.log (inside container)"
 echo ""
 
 # Clear the log file if requested
-if [ "$1" = "--clear" ]; then
+if [ -n "$CLEAR" ]; then
     docker exec "$CONTAINER_ID" sh -c "> /cosmos/proxy.log"
     echo "Log file cleared"
 fi
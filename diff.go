@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/tiborvass/cosmos/utils"
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// cmdDiff shows the changes the agent of a session made to the workdir in its
+// container, against the host workdir. In bind mode the host workdir has them
+// already, they are shown against the workdir as it was when the session started.
+func cmdDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos diff [--stat] <session>")
+		fs.PrintDefaults()
+	}
+	stat := fs.Bool("stat", false, "only show how many lines changed in each file")
+	fs.Parse(args)
+	info := sessionArg(fs)
+
+	ctx := context.Background()
+	var diffArgs []string
+	if *stat {
+		diffArgs = append(diffArgs, "--stat")
+	}
+	if info.Mount == mountBind {
+		// Only the git backend records where the session started.
+		base := info.GitBase
+		if base == "" {
+			base = headCommit(info.Workdir)
+		}
+		if base == "" {
+			fmt.Fprintln(os.Stderr, "the workdir of session", info.ID, "is bind-mounted and not in a git repository, there is nothing to diff it against")
+			os.Exit(1)
+		}
+		cmd := exec.CommandContext(ctx, "git", append(append([]string{"-C", info.Workdir, "diff"}, diffArgs...), base)...)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	tmp := M2(os.MkdirTemp("", "cosmos-diff-"))
+	defer os.RemoveAll(tmp)
+	base, agent := filepath.Join(tmp, "base"), filepath.Join(tmp, "agent")
+	if err := errors.Join(copyHostWorkdir(info.Workdir, base), copySessionWorkdir(ctx, info, agent)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.RemoveAll(tmp)
+		os.Exit(1)
+	}
+
+	M(diffDirs(ctx, tmp, base, agent, os.Stdout, diffArgs...))
+}
+
+// diffDirs writes the git diff from the files of base to those of dir to w,
+// with the extra git diff args. Both trees go through a throwaway repository in
+// scratch, which leaves out the files their .gitignore ignore.
+func diffDirs(ctx context.Context, scratch, base, dir string, w io.Writer, args ...string) error {
+	gitDir := filepath.Join(scratch, "git")
+	if !fileExists(gitDir) {
+		if out, err := exec.CommandContext(ctx, "git", "init", "-q", "--bare", gitDir).CombinedOutput(); err != nil {
+			return fmt.Errorf("git init: %w: %s", err, out)
+		}
+	}
+	r := &gitRepo{gitDir: gitDir, index: filepath.Join(scratch, "index")}
+	tree := func(dir string) (string, error) {
+		if _, err := r.git(ctx, dir, nil, "read-tree", "--empty"); err != nil {
+			return "", err
+		}
+		if _, err := r.git(ctx, dir, nil, "add", "--all", "."); err != nil {
+			return "", err
+		}
+		return r.git(ctx, dir, nil, "write-tree")
+	}
+	from, err := tree(base)
+	if err != nil {
+		return err
+	}
+	to, err := tree(dir)
+	if err != nil {
+		return err
+	}
+	return r.run(ctx, dir, nil, w, append(append([]string{"diff"}, args...), from, to)...)
+}
+
+// copyHostWorkdir copies the files of the host workdir that a session copies
+// into its container to dest.
+func copyHostWorkdir(root, dest string) error {
+	paths, _, _, err := seedFiles(root)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(workdir.WriteTar(pw, root, paths))
+	}()
+	err = workdir.ExtractTar(pr, dest)
+	pr.CloseWithError(err)
+	return err
+}
+
+// copySessionWorkdir copies the workdir in the container of the session to dest.
+func copySessionWorkdir(ctx context.Context, info *sessionInfo, dest string) error {
+	name := containerName(info.ID)
+	out, err := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{.State.Running}}", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("the container of session %s is gone: %s", info.ID, out)
+	}
+	if strings.TrimSpace(string(out)) == "true" {
+		return copyFromContainer(ctx, name, info.Workdir, dest)
+	}
+	if info.Mount == mountOverlay {
+		return fmt.Errorf("the container of session %s stopped, its overlay is not mounted anymore", info.ID)
+	}
+	// docker cp puts the directory itself in the archive.
+	cp := dest + ".cp"
+	cmd := exec.CommandContext(ctx, "docker", "cp", name+":"+info.Workdir, "-")
+	archive, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := workdir.ExtractTar(archive, cp); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("docker cp: %w: %s", err, stderr.String())
+	}
+	return os.Rename(filepath.Join(cp, filepath.Base(info.Workdir)), dest)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// event is something that happened during a session, appended to events.jsonl in the session directory.
+type event struct {
+	Time    time.Time
+	Session string
+	Kind    string
+	Data    json.RawMessage
+}
+
+func logEvent(sess *session, kind string, data json.RawMessage) error {
+	f, err := os.OpenFile(filepath.Join(sessionDir(sess.ID), "events.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(event{Time: time.Now(), Session: sess.ID, Kind: kind, Data: data})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/store"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// cmdExport hands off the workdir of a snapshot of the project in the current
+// directory as a patch, a branch of its repository or a tarball.
+func cmdExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos export <snapshot> [--format=patch|git-branch|tar] [-o <file>] [--branch <name>]")
+		fs.PrintDefaults()
+	}
+	format := fs.String("format", "patch", "\"patch\" against where the session started, or HEAD, \"git-branch\" or \"tar\"")
+	output := fs.String("o", "", "file to write the patch or tarball to, standard output if empty")
+	branch := fs.String("branch", "", "branch to create with --format=git-branch, cosmos/<snapshot> if empty")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	// The flags may come after the snapshot too.
+	id := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	wd := M2(os.Getwd())
+	snap, err := M2(loadState()).Project(wd).Find(id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *format == "tar" {
+		w := exportOutput(*output)
+		M(snapshotTar(ctx, snap, wd, w))
+		M(w.Close())
+		return
+	}
+	if *format != "patch" && *format != "git-branch" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	repo, err := openGitRepo(wd, "export-"+snap.ID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.Remove(repo.index)
+	commit, err := snapshotCommit(ctx, repo, snap, wd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *format == "git-branch" {
+		name := *branch
+		if name == "" {
+			name = "cosmos/" + snapshot.Short(snap.ID)
+		}
+		M2(repo.git(ctx, wd, nil, "branch", name, commit))
+		fmt.Fprintf(os.Stderr, "created branch %s at %s\n", name, commit)
+		return
+	}
+	// The workdir when the session started, so the user's uncommitted changes are not handed off as the agent's.
+	base := snapshotBase(snap, wd)
+	if base == "" {
+		// The session started in an empty repository.
+		base = M2(repo.git(ctx, wd, nil, "hash-object", "-t", "tree", "/dev/null"))
+	}
+	w := exportOutput(*output)
+	M(repo.run(ctx, wd, nil, w, "diff", "--binary", base, commit))
+	M(w.Close())
+}
+
+func exportOutput(name string) io.WriteCloser {
+	if name == "" {
+		return os.Stdout
+	}
+	return M2(os.Create(name))
+}
+
+// snapshotBase returns the commit the session of a snapshot started from. Only the
+// git backend records it, the others go with the current HEAD.
+func snapshotBase(snap *snapshot.Snapshot, wd string) string {
+	if snap.Base != "" {
+		return snap.Base
+	}
+	return headCommit(wd)
+}
+
+// snapshotTar writes the workdir of a snapshot to w as a tar, without its .git.
+func snapshotTar(ctx context.Context, snap *snapshot.Snapshot, wd string, w io.Writer) error {
+	var cmd *exec.Cmd
+	switch {
+	case snap.Commit != "":
+		repo, err := openGitRepo(wd, "export-"+snap.ID)
+		if err != nil {
+			return err
+		}
+		cmd = exec.CommandContext(ctx, "git", "--git-dir", repo.gitDir, "archive", "--format=tar", snap.Commit)
+	case snap.Manifest != "":
+		return storeTar(snap.Manifest, w)
+	case snap.WorkdirArchive:
+		return errors.New("the workdir was bind-mounted, the snapshot doesn't have all of it")
+	default:
+		// In overlay mode, the image only has the changes made on top of the host workdir.
+		if exec.CommandContext(ctx, "docker", "run", "--rm", "--entrypoint", "test", snap.Image, "-d", "/var/lib/cosmos/overlay/upper").Run() == nil {
+			return errors.New("the workdir was mounted as an overlay, the snapshot doesn't have all of it")
+		}
+		cmd = exec.CommandContext(ctx, "docker", "run", "--rm", "--entrypoint", "tar", snap.Image, "-C", wd, "--exclude=./.git", "-cf", "-", ".")
+	}
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// storeTar writes the workdir of the manifest to w as a tar, without its .git.
+func storeTar(manifest string, w io.Writer) error {
+	s, err := store.Open(storeDir)
+	if err != nil {
+		return err
+	}
+	m, err := s.Manifest(manifest)
+	if err != nil {
+		return err
+	}
+	for p := range m {
+		if p == ".git" || strings.HasPrefix(p, ".git/") {
+			delete(m, p)
+		}
+	}
+	return s.WriteTar(w, m, "")
+}
+
+// snapshotCommit returns the commit of the workdir of a snapshot, on top of the
+// commit its session started from. Snapshots taken with the docker backend get
+// one made from their image.
+func snapshotCommit(ctx context.Context, repo *gitRepo, snap *snapshot.Snapshot, wd string) (string, error) {
+	if snap.Commit != "" {
+		return snap.Commit, nil
+	}
+	tmp, err := os.MkdirTemp("", "cosmos-export-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	if err := extractSnapshot(ctx, snap, wd, tmp); err != nil {
+		return "", err
+	}
+	if _, err := repo.git(ctx, tmp, nil, "add", "--all", "."); err != nil {
+		return "", err
+	}
+	tree, err := repo.git(ctx, tmp, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", tree}
+	if base := snapshotBase(snap, wd); base != "" {
+		args = append(args, "-p", base)
+	}
+	return repo.git(ctx, tmp, strings.NewReader(snap.Message), args...)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/transcript"
+	. "github.com/tiborvass/cosmos/utils"
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// fanoutsDir holds a directory per fanout with its report, log and patches.
+var fanoutsDir = filepath.Join(cosmosDir, "fanouts")
+
+// fanoutRun is what a fanout reports of one of its runs.
+type fanoutRun struct {
+	Session  string
+	Snapshot string `json:",omitempty"`
+	// ExitCode is claude's, Result and Cost are from the JSON it prints at the end.
+	ExitCode int
+	Result   string  `json:",omitempty"`
+	Cost     float64 `json:",omitempty"`
+	Usage    transcript.Usage
+	Duration time.Duration
+	// Diff is the short stat of the changes to the workdir, in the file Patch.
+	Diff  string `json:",omitempty"`
+	Patch string `json:",omitempty"`
+	// TestExitCode is the exit code of the test command run in the snapshot, its output is in the file TestLog.
+	TestExitCode *int   `json:",omitempty"`
+	TestLog      string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+}
+
+// fanoutReport is report.json in the directory of a fanout.
+type fanoutReport struct {
+	ID      string
+	Workdir string
+	Prompt  string
+	From    string `json:",omitempty"`
+	Test    string `json:",omitempty"`
+	Started time.Time
+	Runs    []*fanoutRun
+}
+
+// cmdFanout runs the same prompt in n sessions at once, from the same snapshot
+// or the host workdir, and compares what they did.
+func cmdFanout(args []string) {
+	fs := flag.NewFlagSet("fanout", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos [<option>...] fanout [-n <runs>] [--from <snapshot>] [--test <command>] --prompt <prompt>")
+		fs.PrintDefaults()
+	}
+	n := fs.Int("n", 2, "how many agents run the prompt")
+	prompt := fs.String("prompt", "", "the prompt each agent runs headlessly")
+	from := fs.String("from", "", "snapshot or tag the agents start from, instead of the host workdir")
+	test := fs.String("test", "", "shell command run in the workdir of each result, e.g. \"go test ./...\"")
+	keep := fs.Bool("keep", false, "keep the containers of the runs, for cosmos diff and logs")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *prompt == "" || *n < 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	// The runs are compared through their images.
+	if opts.SnapshotBackend != backendDocker || opts.Mount != mountCopy {
+		fmt.Fprintln(os.Stderr, "cosmos fanout needs --snapshot-backend=docker and --mount-mode=copy")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	wd := M2(os.Getwd())
+	var base *snapshot.Snapshot
+	if *from != "" {
+		var err error
+		if base, err = M2(loadState()).Project(wd).Find(*from); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if base.Image == "" {
+			fmt.Fprintln(os.Stderr, "snapshot", snapshot.Short(base.ID), "has no image to start from")
+			os.Exit(1)
+		}
+	}
+
+	report := &fanoutReport{ID: randomID(8), Workdir: wd, Prompt: *prompt, Test: *test, Started: time.Now()}
+	dir := filepath.Join(fanoutsDir, report.ID)
+	M(os.MkdirAll(dir, 0755))
+	logFile = M2(os.OpenFile(filepath.Join(dir, "cosmos.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644))
+	defer os.RemoveAll(filepath.Join(dir, "scratch"))
+
+	// The changes of each run are against the workdir they all started with.
+	var seed []string
+	baseDir := filepath.Join(dir, "scratch", "base")
+	if base != nil {
+		report.From = base.ID
+		M(extractSnapshot(ctx, base, wd, baseDir))
+	} else {
+		paths, files, size, err := seedFiles(wd)
+		M(err)
+		seed = paths
+		fmt.Fprintf(os.Stderr, "cosmos: copying %d files (%s) of %s into %d containers\n", files, formatSize(size), wd, *n)
+		M(copyHostWorkdir(wd, baseDir))
+	}
+
+	fmt.Fprintf(os.Stderr, "cosmos: fanout %s, running %d agents\n", report.ID, *n)
+	report.Runs = make([]*fanoutRun, *n)
+	var wg sync.WaitGroup
+	for i := range *n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run := &fanoutRun{}
+			report.Runs[i] = run
+			if err := fanout(ctx, run, wd, base, seed, *prompt, *keep); err != nil {
+				run.Error = err.Error()
+				fmt.Fprintln(logFile, "run", i+1, err)
+				return
+			}
+			if err := compareRun(ctx, run, wd, dir, baseDir, i+1, *test); err != nil {
+				run.Error = err.Error()
+				fmt.Fprintln(logFile, "run", i+1, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	M(os.WriteFile(filepath.Join(dir, "report.json"), M2(json.MarshalIndent(report, "", "\t")), 0644))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSESSION\tSNAPSHOT\tEXIT\tTEST\tTOKENS IN/OUT\tCOST\tDURATION\tCHANGES")
+	for i, r := range report.Runs {
+		exit, test, changes := "-", "-", r.Diff
+		if r.Error == "" {
+			exit = fmt.Sprint(r.ExitCode)
+		} else {
+			changes = "error: " + r.Error
+		}
+		if r.TestExitCode != nil {
+			test = fmt.Sprint(*r.TestExitCode)
+		}
+		if changes == "" {
+			changes = "none"
+		}
+		in := r.Usage.InputTokens + r.Usage.CacheCreationInputTokens + r.Usage.CacheReadInputTokens
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%d/%d\t$%.2f\t%s\t%s\n", i+1, r.Session, snapshot.Short(r.Snapshot), exit, test,
+			in, r.Usage.OutputTokens, r.Cost, r.Duration.Round(time.Second), changes)
+	}
+	tw.Flush()
+	fmt.Println("report, patches and test logs in", dir)
+}
+
+// fanout runs the prompt in a new headless session, from the image of base or a
+// copy of the seed files of the workdir, and snapshots the result.
+func fanout(ctx context.Context, run *fanoutRun, wd string, base *snapshot.Snapshot, seed []string, prompt string, keep bool) error {
+	sess := &session{ID: randomID(8), Workdir: wd, headless: true}
+	run.Session = sess.ID
+	if err := os.MkdirAll(sessionDir(sess.ID), 0755); err != nil {
+		return err
+	}
+	if err := saveSessionInfo(sess); err != nil {
+		return err
+	}
+	img, claudeArgs := "cosmos", "-p --output-format json"
+	if base != nil {
+		img, claudeArgs, sess.Head = base.Image, "-c "+claudeArgs, base.ID
+	}
+
+	start := time.Now()
+	shArgs := dockerRun(sess, img, false, claudeArgs) + fmt.Sprintf(" %q", prompt)
+	fmt.Fprintln(logFile, "exec", shArgs)
+	out, err := exec.CommandContext(ctx, "sh", "-c", shArgs).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("docker run: %w: %s", err, out)
+	}
+	sess.Container = strings.TrimSpace(string(out))
+	if !keep {
+		defer exec.Command("docker", "rm", "-f", sess.Container).Run()
+	}
+	if base == nil {
+		if err := seedWorkdir(ctx, sess.Container, sess.Workdir, seed); err != nil {
+			return err
+		}
+		if out, err := exec.CommandContext(ctx, "docker", "exec", "-u", "root", sess.Container, "chown", "-R", "cosmos:cosmos", sess.Workdir).CombinedOutput(); err != nil {
+			return fmt.Errorf("chown: %w: %s", err, out)
+		}
+	}
+	out, err = exec.CommandContext(ctx, "docker", "port", sess.Container, "8042/tcp").Output()
+	if err != nil {
+		return fmt.Errorf("docker port: %w", err)
+	}
+	// Docker lists the IPv4 address first.
+	addr, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	// The turns are snapshotted as in any session, manage returns when the container exits.
+	manage(ctx, sess, connectManager(ctx, sess.Container, addr))
+
+	out, err = exec.CommandContext(ctx, "docker", "wait", sess.Container).Output()
+	if err != nil {
+		return fmt.Errorf("docker wait: %w", err)
+	}
+	run.Duration = time.Since(start)
+	fmt.Sscan(string(out), &run.ExitCode)
+	var stdout bytes.Buffer
+	logs := exec.CommandContext(ctx, "docker", "logs", sess.Container)
+	logs.Stdout = &stdout
+	if err := logs.Run(); err != nil {
+		return fmt.Errorf("docker logs: %w", err)
+	}
+	run.Result, run.Cost = claudeResult(&stdout)
+	if f, err := os.Open(filepath.Join(sessionDir(sess.ID), "exchanges.jsonl")); err == nil {
+		exchanges, _ := transcript.ReadExchanges(f)
+		f.Close()
+		for _, x := range exchanges {
+			run.Usage.InputTokens += x.Usage.InputTokens
+			run.Usage.OutputTokens += x.Usage.OutputTokens
+			run.Usage.CacheCreationInputTokens += x.Usage.CacheCreationInputTokens
+			run.Usage.CacheReadInputTokens += x.Usage.CacheReadInputTokens
+		}
+	}
+
+	// A turn without tool calls is not snapshotted, and claude may exit before the
+	// last snapshot is taken: the result gets one of its own, unless the head was
+	// taken after claude exited.
+	out, err = exec.CommandContext(ctx, "docker", "inspect", "--format", "{{.State.FinishedAt}}", sess.Container).Output()
+	if err != nil {
+		return fmt.Errorf("docker inspect: %w", err)
+	}
+	finished, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(out)))
+	if err != nil {
+		return fmt.Errorf("docker inspect: %w", err)
+	}
+	st, err := loadState()
+	if err != nil {
+		return err
+	}
+	if head := st.Project(wd).Get(sess.Head); head == nil || base != nil && head.ID == base.ID || !head.Created.After(finished) {
+		snap := &snapshot.Snapshot{
+			ID:        randomID(16),
+			Parent:    sess.Head,
+			Message:   "fanout: " + prompt,
+			SessionID: sess.ID,
+			Created:   time.Now(),
+			Base:      sess.GitBase,
+		}
+		if err := dockerSnapshot(ctx, sess, snap); err != nil {
+			return err
+		}
+		if err := updateState(func(st *State) error {
+			st.Project(sess.Workdir).Add(snap)
+			return nil
+		}); err != nil {
+			return err
+		}
+		sess.Head = snap.ID
+	}
+	run.Snapshot = sess.Head
+	return nil
+}
+
+// claudeResult returns the result and cost from the JSON claude -p prints last.
+func claudeResult(r io.Reader) (string, float64) {
+	var res struct {
+		Result       string  `json:"result"`
+		TotalCostUSD float64 `json:"total_cost_usd"`
+	}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+	for s.Scan() {
+		if line := bytes.TrimSpace(s.Bytes()); bytes.HasPrefix(line, []byte("{")) {
+			json.Unmarshal(line, &res)
+		}
+	}
+	return res.Result, res.TotalCostUSD
+}
+
+// compareRun saves the patch of the changes of run against the workdir in
+// baseDir, and runs the test command in its snapshot.
+func compareRun(ctx context.Context, run *fanoutRun, wd, dir, baseDir string, i int, test string) error {
+	st, err := loadState()
+	if err != nil {
+		return err
+	}
+	snap := st.Project(wd).Get(run.Snapshot)
+	scratch := filepath.Join(dir, "scratch", run.Session)
+	result := filepath.Join(scratch, "workdir")
+	if err := extractSnapshot(ctx, snap, wd, result); err != nil {
+		return err
+	}
+	run.Patch = filepath.Join(dir, fmt.Sprintf("run-%d.patch", i))
+	f, err := os.Create(run.Patch)
+	if err != nil {
+		return err
+	}
+	err = diffDirs(ctx, scratch, baseDir, result, f, "--binary")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	var stat strings.Builder
+	if err := diffDirs(ctx, scratch, baseDir, result, &stat, "--shortstat"); err != nil {
+		return err
+	}
+	run.Diff = strings.TrimSpace(stat.String())
+	if test == "" {
+		return nil
+	}
+
+	run.TestLog = filepath.Join(dir, fmt.Sprintf("run-%d.test.log", i))
+	// The tests are the agent's code, they run as sandboxed as it did.
+	out, err := exec.CommandContext(ctx, "sh", "-c", throwawayRun(snap.Image, wd, verifyTimeout), "sh", test).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fmt.Errorf("running the test command: %w: %s", err, out)
+	}
+	code := 0
+	if exitErr != nil {
+		code = exitErr.ExitCode()
+	}
+	if timedOut(code) {
+		out = fmt.Appendf(out, "\ncosmos: stopped after %v\n", verifyTimeout)
+	}
+	run.TestExitCode = &code
+	return os.WriteFile(run.TestLog, out, 0644)
+}
+
+// extractSnapshot extracts the workdir of snap to dest.
+func extractSnapshot(ctx context.Context, snap *snapshot.Snapshot, wd, dest string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(snapshotTar(ctx, snap, wd, pw))
+	}()
+	err := workdir.ExtractTar(pr, dest)
+	pr.CloseWithError(err)
+	return err
+}
+
+// randomID returns n random bytes, hex encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	M2(rand.Read(b))
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// agentStatePaths are written by the agent itself on every turn or tool call,
+// changes under them alone don't make a snapshot worth taking.
+var agentStatePaths = []string{
+	"/home/cosmos/.claude/",
+	"/tmp/claude-",
+}
+
+// fsFingerprint identifies the state of the container filesystem. docker diff
+// lists the paths changed since the container started but a path changed again
+// after a snapshot stays listed, so their size and modification times are
+// included as well.
+func fsFingerprint(ctx context.Context, container string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", "diff", container).Output()
+	if err != nil {
+		return "", fmt.Errorf("docker diff: %w", err)
+	}
+
+	h := sha256.New()
+	var paths bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		kind, path, ok := strings.Cut(s.Text(), " ")
+		if !ok || isAgentState(path) {
+			continue
+		}
+		fmt.Fprintln(h, kind, path)
+		if kind != "D" {
+			paths.WriteString(path)
+			paths.WriteByte(0)
+		}
+	}
+	if paths.Len() > 0 {
+		cmd := exec.CommandContext(ctx, "docker", "exec", "-i", "-u", "root", container, "xargs", "-0", "stat", "-c", "%n %s %.9Y %.9Z", "--")
+		cmd.Stdin = &paths
+		// Paths removed since docker diff ran make stat fail, what it printed is still a valid fingerprint.
+		out, _ := cmd.Output()
+		h.Write(out)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func isAgentState(path string) bool {
+	for _, p := range agentStatePaths {
+		if strings.HasPrefix(path, p) || path+"/" == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/store"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// fsckProblem is something wrong with a recorded snapshot. Dropping the snapshot
+// always fixes it, relinking does when fix is set. Warnings don't keep the
+// snapshot from being restored, they are only reported.
+type fsckProblem struct {
+	snap    *snapshot.Snapshot
+	what    string
+	relink  string                   // what relinking does
+	fix     func(*snapshot.Snapshot) // relinks the snapshot, as found in the state being updated
+	warning bool
+}
+
+// cmdFsck checks that what the snapshots of the project in the current directory
+// were recorded with is still there, and drops or relinks the broken ones.
+func cmdFsck(args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos fsck [-n|-y]")
+		fs.PrintDefaults()
+	}
+	dryRun := fs.Bool("n", false, "only report the problems")
+	yes := fs.Bool("y", false, "relink the broken snapshots that can be, drop the others, without asking")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *dryRun && *yes {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	workdir := M2(os.Getwd())
+	tree := M2(loadState()).Project(workdir)
+	var problems []fsckProblem
+	for _, s := range tree.Snapshots {
+		problems = append(problems, fsckSnapshot(ctx, workdir, tree, s)...)
+	}
+	if !slices.ContainsFunc(problems, func(p fsckProblem) bool { return !p.warning }) {
+		for _, p := range problems {
+			fmt.Printf("%s %s: warning: %s\n", snapshot.Short(p.snap.ID), p.snap.Summary(), p.what)
+		}
+		fmt.Printf("%d snapshots, no problems\n", len(tree.Snapshots))
+		return
+	}
+
+	ask := !*dryRun && !*yes && isatty.IsTerminal(os.Stdin.Fd())
+	in := bufio.NewReader(os.Stdin)
+	drop := map[string]bool{}
+	var dropped []string
+	var relinks []fsckProblem
+	for _, p := range problems {
+		if p.warning {
+			fmt.Printf("%s %s: warning: %s\n", snapshot.Short(p.snap.ID), p.snap.Summary(), p.what)
+			continue
+		}
+		fmt.Printf("%s %s: %s\n", snapshot.Short(p.snap.ID), p.snap.Summary(), p.what)
+		if drop[p.snap.ID] {
+			continue
+		}
+		// The workdir archives of bind mode only hold what changed since the parent's:
+		// without this one, the children's restores would miss files.
+		child := archivedChild(tree, p.snap.ID)
+		if child != nil {
+			fmt.Printf("  can't be dropped, the workdir archive of %s builds on it\n", snapshot.Short(child.ID))
+		}
+		action := ""
+		switch {
+		case *yes && p.fix != nil:
+			action = "r"
+		case *yes && child == nil:
+			action = "d"
+		case ask && child != nil && p.fix == nil:
+			// Nothing to offer.
+		case ask:
+			question := "  [d]rop, or [s]kip? "
+			switch {
+			case child != nil:
+				question = fmt.Sprintf("  [r]elink (%s), or [s]kip? ", p.relink)
+			case p.fix != nil:
+				question = fmt.Sprintf("  [r]elink (%s), [d]rop, or [s]kip? ", p.relink)
+			}
+			fmt.Print(question)
+			line, _ := in.ReadString('\n')
+			action = strings.ToLower(strings.TrimSpace(line))
+		}
+		switch {
+		case action == "r" && p.fix != nil:
+			relinks = append(relinks, p)
+		case action == "d" && child == nil:
+			drop[p.snap.ID] = true
+			dropped = append(dropped, p.snap.ID)
+		}
+	}
+	if len(drop) == 0 && len(relinks) == 0 {
+		if !*dryRun && !ask {
+			fmt.Fprintln(os.Stderr, "run cosmos fsck in a terminal to fix the problems, or with -y")
+		}
+		os.Exit(1)
+	}
+	M(updateState(func(st *State) error {
+		tree := st.Project(workdir)
+		for _, p := range relinks {
+			if s := tree.Get(p.snap.ID); s != nil && !drop[s.ID] {
+				p.fix(s)
+			}
+		}
+		for _, id := range dropped {
+			tree.Drop(id)
+		}
+		return nil
+	}))
+	for _, p := range relinks {
+		if !drop[p.snap.ID] {
+			fmt.Println("relinked", snapshot.Short(p.snap.ID)+":", p.relink)
+		}
+	}
+	for _, id := range dropped {
+		// Whatever is left of it goes too.
+		removeSnapshot(ctx, workdir, tree.Get(id))
+		fmt.Println("dropped", snapshot.Short(id))
+	}
+}
+
+// archivedChild returns a child of the snapshot id with a workdir archive, or nil.
+func archivedChild(tree *snapshot.Tree, id string) *snapshot.Snapshot {
+	for _, s := range tree.Snapshots {
+		if s.Parent == id && s.WorkdirArchive {
+			return s
+		}
+	}
+	return nil
+}
+
+// fsckSnapshot returns the problems of the snapshot s of tree.
+func fsckSnapshot(ctx context.Context, workdir string, tree *snapshot.Tree, s *snapshot.Snapshot) []fsckProblem {
+	var problems []fsckProblem
+	if s.Parent != "" && tree.Get(s.Parent) == nil {
+		// The snapshot taken before it in the same session is the best guess.
+		parent := ""
+		for _, x := range tree.Snapshots {
+			if x == s {
+				break
+			}
+			if x.SessionID == s.SessionID {
+				parent = x.ID
+			}
+		}
+		relink := "make it a root"
+		if parent != "" {
+			relink = "take " + snapshot.Short(parent) + " as parent"
+		}
+		problems = append(problems, fsckProblem{snap: s, what: "parent " + snapshot.Short(s.Parent) + " is missing", relink: relink,
+			fix: func(s *snapshot.Snapshot) { s.Parent = parent }})
+	}
+	if s.Image != "" {
+		// Squashing moves the tag to a new image, the recorded one may be late.
+		tagged, _ := imageID(ctx, "cosmos:"+s.ID)
+		recorded, err := imageID(ctx, s.Image)
+		switch {
+		case err != nil && tagged == "":
+			problems = append(problems, fsckProblem{snap: s, what: "image " + s.Image + " is missing"})
+		case err != nil:
+			problems = append(problems, fsckProblem{snap: s, what: "image " + s.Image + " is missing, cosmos:" + s.ID + " is " + tagged,
+				relink: "use " + tagged, fix: func(s *snapshot.Snapshot) { s.Image = tagged }})
+		case tagged != "" && tagged != recorded:
+			problems = append(problems, fsckProblem{snap: s, what: "image is " + recorded + " but cosmos:" + s.ID + " is " + tagged,
+				relink: "use " + tagged, fix: func(s *snapshot.Snapshot) { s.Image = tagged }})
+		}
+	}
+	if err := checkSnapshot(ctx, workdir, s, true); err != nil {
+		problems = append(problems, fsckProblem{snap: s, what: err.Error()})
+	}
+	if s.Commit != "" && !fileExists(claudeStatePath(s.ID)) {
+		// Restoring goes on without them, claude starts a new conversation.
+		problems = append(problems, fsckProblem{snap: s, what: "claude's sessions are missing", warning: true})
+	}
+	return problems
+}
+
+// imageID returns the ID of image.
+func imageID(ctx context.Context, image string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format", "{{.Id}}", image).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// checkSnapshot returns why s can't be restored, if its commit, manifests or
+// workdir archive are missing. Its image is checked too unless fsck does it. A
+// thorough check also makes sure the store has every file of the manifests.
+func checkSnapshot(ctx context.Context, workdir string, s *snapshot.Snapshot, thorough bool) error {
+	var errs []error
+	if s.Image != "" && !thorough {
+		if _, err := imageID(ctx, s.Image); err != nil {
+			errs = append(errs, fmt.Errorf("image %s is missing", s.Image))
+		}
+	}
+	if s.Commit != "" {
+		if exec.CommandContext(ctx, "git", "-C", workdir, "cat-file", "-e", s.Commit+"^{commit}").Run() != nil {
+			errs = append(errs, fmt.Errorf("commit %s is missing", s.Commit))
+		}
+	}
+	if s.WorkdirArchive && (!fileExists(archivePath(s.ID)) || !fileExists(manifestPath(s.ID))) {
+		errs = append(errs, errors.New("workdir archive is missing"))
+	}
+	if s.Manifest != "" {
+		st, err := store.Open(storeDir)
+		if err != nil {
+			return err
+		}
+		for _, d := range []string{s.Manifest, s.ClaudeManifest} {
+			if d == "" {
+				continue
+			}
+			m, err := st.Manifest(d)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("manifest %s: %w", d, err))
+				continue
+			}
+			if !thorough {
+				continue
+			}
+			missing := 0
+			for _, e := range m {
+				if e.Digest != "" && !st.Has(e.Digest) {
+					missing++
+				}
+			}
+			if missing > 0 {
+				errs = append(errs, fmt.Errorf("%d files of manifest %s are missing from the store", missing, d))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
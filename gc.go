@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/store"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// cmdGC removes the snapshots of the project in the current directory taken
+// before a cutoff, with what they hold, but for the tagged ones and the
+// snapshots they were taken on top of.
+func cmdGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos gc [-n] [--older-than <duration>]")
+		fs.PrintDefaults()
+	}
+	olderThan := fs.Duration("older-than", 7*24*time.Hour, "remove the snapshots taken longer ago than this")
+	dryRun := fs.Bool("n", false, "only show what would be removed")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	workdir := M2(os.Getwd())
+	cutoff := time.Now().Add(-*olderThan)
+	var removed []*snapshot.Snapshot
+	prune := func(st *State) error {
+		removed = st.Project(workdir).Prune(func(s *snapshot.Snapshot) bool {
+			return len(s.Tags) > 0 || s.Created.After(cutoff)
+		})
+		return nil
+	}
+	if *dryRun {
+		M(prune(M2(loadState())))
+	} else {
+		M(updateState(prune))
+	}
+
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	gitSessions := map[string]bool{}
+	for _, s := range removed {
+		fmt.Println(verb, snapshot.Short(s.ID), s.Created.Local().Format(time.DateTime), s.Summary())
+		if *dryRun {
+			continue
+		}
+		if err := removeSnapshot(ctx, workdir, s); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v\n", snapshot.Short(s.ID), err)
+		}
+		if s.Commit != "" {
+			gitSessions[s.SessionID] = true
+		}
+	}
+	// The start of a git session is kept as long as one of its snapshots is.
+	if len(gitSessions) > 0 {
+		tree := M2(loadState()).Project(workdir)
+		for id := range gitSessions {
+			if slices.ContainsFunc(tree.Snapshots, func(s *snapshot.Snapshot) bool { return s.SessionID == id }) {
+				continue
+			}
+			if out, err := exec.CommandContext(ctx, "git", "-C", workdir, "update-ref", "-d", baseRef(id)).CombinedOutput(); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: session %s: git update-ref: %v: %s\n", id, err, out)
+			}
+		}
+	}
+	if *dryRun || !fileExists(storeDir) {
+		return
+	}
+
+	// The store is shared by the projects, what their snapshots use stays.
+	var manifests []string
+	for _, tree := range M2(loadState()).Projects {
+		for _, s := range tree.Snapshots {
+			for _, d := range []string{s.Manifest, s.ClaudeManifest} {
+				if d != "" {
+					manifests = append(manifests, d)
+				}
+			}
+		}
+	}
+	n, size, err := M2(store.Open(storeDir)).Sweep(manifests, time.Hour)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sweeping the store:", err)
+		os.Exit(1)
+	}
+	if n > 0 {
+		fmt.Printf("removed %d blobs (%s) from the store\n", n, formatSize(size))
+	}
+}
+
+// removeSnapshot removes the image, ref and files of a snapshot.
+func removeSnapshot(ctx context.Context, workdir string, s *snapshot.Snapshot) error {
+	var errs []error
+	if s.Image != "" {
+		// The layers stay as long as the images of later snapshots have them.
+		if out, err := exec.CommandContext(ctx, "docker", "image", "rm", "cosmos:"+s.ID).CombinedOutput(); err != nil && !strings.Contains(string(out), "No such image") {
+			errs = append(errs, fmt.Errorf("docker image rm: %w: %s", err, out))
+		}
+	}
+	if s.Ref != "" {
+		if out, err := exec.CommandContext(ctx, "git", "-C", workdir, "update-ref", "-d", s.Ref).CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("git update-ref: %w: %s", err, out))
+		}
+	}
+	for _, name := range []string{claudeStatePath(s.ID), archivePath(s.ID), manifestPath(s.ID)} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// Snapshot backends.
+const (
+	backendDocker = "docker" // docker commit of the whole container
+	backendGit    = "git"    // commit of the workdir in the host repository
+)
+
+// claudeProjects is where claude keeps its sessions in the container. The git
+// backend saves it next to each commit, for claude to resume from.
+const claudeProjects = "/home/cosmos/.claude/projects"
+
+// gitRepo is the host repository of the workdir, which the git backend commits
+// to without touching its index, HEAD or branches.
+type gitRepo struct {
+	gitDir string
+	index  string // the session's index, in the cosmos directory
+}
+
+// openGitRepo returns the repository of workdir, which has to be its top level.
+func openGitRepo(workdir, session string) (*gitRepo, error) {
+	out, err := exec.Command("git", "-C", workdir, "rev-parse", "--show-toplevel", "--absolute-git-dir").Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s is not in a git repository", workdir)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		return nil, fmt.Errorf("git rev-parse: unexpected output %q", out)
+	}
+	if evalSymlinks(lines[0]) != evalSymlinks(workdir) {
+		return nil, fmt.Errorf("%s is not the top level of its git repository, %s is", workdir, lines[0])
+	}
+	dir := filepath.Join(cosmosDir, "git")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &gitRepo{gitDir: lines[1], index: filepath.Join(dir, session+".index")}, nil
+}
+
+// evalSymlinks resolves the symbolic links of path, or returns it as is.
+func evalSymlinks(path string) string {
+	if p, err := filepath.EvalSymlinks(path); err == nil {
+		return p
+	}
+	return path
+}
+
+// git runs a git command on worktree, with the session's index, and returns its trimmed output.
+func (r *gitRepo) git(ctx context.Context, worktree string, stdin io.Reader, args ...string) (string, error) {
+	var out bytes.Buffer
+	if err := r.run(ctx, worktree, stdin, &out, args...); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// run runs a git command on worktree, with the session's index, writing its output to w.
+func (r *gitRepo) run(ctx context.Context, worktree string, stdin io.Reader, w io.Writer, args ...string) error {
+	name := args[0]
+	// The worktree is extracted anew for every snapshot, only sizes and modification times tell whether a file changed.
+	args = append([]string{"--git-dir", r.gitDir, "--work-tree", worktree, "-c", "core.trustctime=false", "-c", "core.checkStat=minimal"}, args...)
+	cmd := exec.CommandContext(ctx, "git", args...)
+	// The agent authors the snapshots, the user commits them.
+	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+r.index, "GIT_AUTHOR_NAME=cosmos", "GIT_AUTHOR_EMAIL=cosmos@localhost")
+	cmd.Stdin = stdin
+	cmd.Stdout = w
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", name, err, stderr.Bytes())
+	}
+	return nil
+}
+
+// headCommit returns the commit checked out in the repository of workdir, empty
+// outside of a repository or in one without commits.
+func headCommit(workdir string) string {
+	out, _ := exec.Command("git", "-C", workdir, "rev-parse", "--verify", "--quiet", "HEAD").Output()
+	return strings.TrimSpace(string(out))
+}
+
+// startCommit records the workdir as it is when the session starts, with its
+// uncommitted changes, as a commit on top of HEAD under its baseRef.
+// It is HEAD if the workdir has no changes, or if it is not the top level of its
+// repository, and empty outside of a repository.
+func startCommit(ctx context.Context, workdir, session string) (string, error) {
+	head := headCommit(workdir)
+	r, err := openGitRepo(workdir, session)
+	if err != nil {
+		return head, nil
+	}
+	if _, err := r.git(ctx, workdir, nil, "read-tree", "--empty"); err != nil {
+		return "", err
+	}
+	if _, err := r.git(ctx, workdir, nil, "add", "--all", "."); err != nil {
+		return "", err
+	}
+	tree, err := r.git(ctx, workdir, nil, "write-tree")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", tree}
+	if head != "" {
+		if headTree, _ := r.git(ctx, workdir, nil, "rev-parse", head+"^{tree}"); headTree == tree {
+			return head, nil
+		}
+		args = append(args, "-p", head)
+	}
+	commit, err := r.git(ctx, workdir, strings.NewReader("cosmos: workdir at the start of session "+session), args...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := r.git(ctx, workdir, nil, "update-ref", baseRef(session), commit); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// baseRef is the ref startCommit keeps the start of a session under.
+func baseRef(session string) string {
+	return "refs/cosmos/base/" + session
+}
+
+// commit records the workdir of the session as a commit on top of parent, or of
+// nothing if parent is empty, under refs/cosmos/<session>/<n>.
+func (r *gitRepo) commit(ctx context.Context, sess *session, parent, message string) (commit, ref string, err error) {
+	worktree := sess.Workdir
+	if opts.Mount != mountBind {
+		// Only the container has the agent's changes.
+		tmp, err := os.MkdirTemp("", "cosmos-worktree-")
+		if err != nil {
+			return "", "", err
+		}
+		defer os.RemoveAll(tmp)
+		if err := copyFromContainer(ctx, sess.Container, sess.Workdir, tmp, "--exclude=./.git"); err != nil {
+			return "", "", err
+		}
+		worktree = tmp
+	}
+	if _, err := r.git(ctx, worktree, nil, "add", "--all", "."); err != nil {
+		return "", "", err
+	}
+	tree, err := r.git(ctx, worktree, nil, "write-tree")
+	if err != nil {
+		return "", "", err
+	}
+	args := []string{"commit-tree", tree}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	if commit, err = r.git(ctx, worktree, strings.NewReader(message), args...); err != nil {
+		return "", "", err
+	}
+	refs, err := r.git(ctx, worktree, nil, "for-each-ref", "--format=%(refname)", "refs/cosmos/"+sess.ID+"/")
+	if err != nil {
+		return "", "", err
+	}
+	ref = fmt.Sprintf("refs/cosmos/%s/%d", sess.ID, len(strings.Fields(refs))+1)
+	if _, err := r.git(ctx, worktree, nil, "update-ref", ref, commit); err != nil {
+		return "", "", err
+	}
+	return commit, ref, nil
+}
+
+// restore brings the workdir of the session back to commit: the host workdir in
+// bind mode, the container's otherwise.
+func (r *gitRepo) restore(ctx context.Context, sess *session, commit string) error {
+	if opts.Mount == mountBind {
+		// The index holds the last snapshot, the files it has and commit doesn't are removed.
+		_, err := r.git(ctx, sess.Workdir, nil, "read-tree", "-u", "--reset", commit)
+		return err
+	}
+	if _, err := r.git(ctx, sess.Workdir, nil, "read-tree", commit); err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "git", "--git-dir", r.gitDir, "archive", commit)
+	archive, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := copyToContainer(ctx, sess.Container, sess.Workdir, archive); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+// claudeStatePath is where the git backend saves claude's sessions at a snapshot.
+func claudeStatePath(snapshotID string) string {
+	return filepath.Join(cosmosDir, "git", snapshotID+"-claude.tar")
+}
+
+// saveClaudeState saves claude's sessions in the container for the snapshot.
+func saveClaudeState(ctx context.Context, container, snapshotID string) error {
+	f, err := os.Create(claudeStatePath(snapshotID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd := exec.CommandContext(ctx, "docker", "exec", container, "tar", "-C", claudeProjects, "-cf", "-", ".")
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = f, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("saving claude's sessions: %w: %s", err, stderr.Bytes())
+	}
+	return nil
+}
+
+// restoreClaudeState puts back claude's sessions saved at a snapshot in the container.
+func restoreClaudeState(ctx context.Context, container, snapshotID string) error {
+	f, err := os.Open(claudeStatePath(snapshotID))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return copyToContainer(ctx, container, claudeProjects, f)
+}
+
+// copyFromContainer extracts the directory dir of the container under dest.
+func copyFromContainer(ctx context.Context, container, dir, dest string, tarArgs ...string) error {
+	cmd := exec.CommandContext(ctx, "docker", append(append([]string{"exec", container, "tar", "-C", dir}, tarArgs...), "-cf", "-", ".")...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := workdir.ExtractTar(out, dest); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("docker exec tar: %w: %s", err, stderr.Bytes())
+	}
+	return nil
+}
+
+// copyToContainer extracts the tar read from r in the directory dir of the
+// container, owned by the agent.
+func copyToContainer(ctx context.Context, container, dir string, r io.Reader) error {
+	if out, err := exec.CommandContext(ctx, "docker", "exec", "-u", "root", container, "mkdir", "-p", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker exec mkdir: %w: %s", err, out)
+	}
+	cmd := exec.CommandContext(ctx, "docker", "cp", "-", container+":"+dir)
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("docker cp: %w: %s", err, out)
+	}
+	if out, err := exec.CommandContext(ctx, "docker", "exec", "-u", "root", container, "chown", "-R", "cosmos:cosmos", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker exec chown: %w: %s", err, out)
+	}
+	return nil
+}
+
+// gitParent returns the commit a new snapshot of the session goes on top of.
+func gitParent(tree *snapshot.Tree, sess *session) string {
+	if s := tree.Get(sess.Head); s != nil && s.Commit != "" {
+		return s.Commit
+	}
+	return sess.GitBase
+}
@@ -0,0 +1,165 @@
+// Package history identifies agent conversations by chains of message hashes.
+//
+// The agent resends the whole conversation with every API request. Hashing each
+// message together with everything before it gives one hash per conversation
+// point, so two requests share a history exactly as far as their chains agree.
+// This lets the proxy notice when the user goes back to an earlier point of the
+// conversation. Which snapshot was taken at which point is kept with the
+// snapshots, see snapshot.Tree.RestorePoint, not here.
+package history
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// volatileFields are removed from messages before hashing, because the agent
+// changes them between requests without changing the conversation.
+var volatileFields = map[string]struct{}{
+	"cache_control": {},
+}
+
+// Hash identifies a conversation point: a message and all the messages before it.
+type Hash [sha256.Size]byte
+
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// IsZero reports whether h is the zero Hash, which precedes any message.
+func (h Hash) IsZero() bool {
+	return h == Hash{}
+}
+
+// ParseHash parses the hexadecimal form returned by Hash.String.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return h, err
+	}
+	if len(b) != len(h) {
+		return h, fmt.Errorf("invalid hash length %d", len(b))
+	}
+	copy(h[:], b)
+	return h, nil
+}
+
+// Canonicalize returns a stable encoding of the JSON value v: object keys are
+// sorted, volatile fields are dropped and a plain string message content is
+// expanded to the equivalent single text block.
+func Canonicalize(v json.RawMessage) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(v))
+	d.UseNumber()
+	var x any
+	if err := d.Decode(&x); err != nil {
+		return nil, err
+	}
+	return json.Marshal(canonical(x))
+}
+
+func canonical(x any) any {
+	switch x := x.(type) {
+	case map[string]any:
+		for k, v := range x {
+			if _, ok := volatileFields[k]; ok {
+				delete(x, k)
+				continue
+			}
+			x[k] = canonical(v)
+		}
+		if s, ok := x["content"].(string); ok {
+			x["content"] = []any{map[string]any{"type": "text", "text": s}}
+		}
+	case []any:
+		for i, v := range x {
+			x[i] = canonical(v)
+		}
+	}
+	return x
+}
+
+// Sum returns the hash of the canonical form of v.
+func Sum(v json.RawMessage) (Hash, error) {
+	b, err := Canonicalize(v)
+	if err != nil {
+		return Hash{}, err
+	}
+	return sha256.Sum256(b), nil
+}
+
+// Chain holds one Hash per message: Chain[i] covers messages 0 through i.
+type Chain []Hash
+
+// NewChain hashes the messages of a conversation.
+func NewChain(msgs []json.RawMessage) (Chain, error) {
+	c := make(Chain, len(msgs))
+	var prev Hash
+	for i, msg := range msgs {
+		b, err := Canonicalize(msg)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		h := sha256.New()
+		h.Write(prev[:])
+		h.Write(b)
+		h.Sum(prev[:0])
+		c[i] = prev
+	}
+	return c, nil
+}
+
+// Head returns the hash of the whole chain, or the zero Hash if it is empty.
+func (c Chain) Head() Hash {
+	if len(c) == 0 {
+		return Hash{}
+	}
+	return c[len(c)-1]
+}
+
+// CommonPrefix returns the number of messages a and b have in common.
+func CommonPrefix(a, b Chain) int {
+	n := min(len(a), len(b))
+	// Each hash covers its whole prefix, so chains agree up to a point and then differ for good.
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if a[mid] == b[mid] {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Tracker follows the conversations of several sessions.
+type Tracker struct {
+	m        sync.Mutex
+	sessions map[string]Chain
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		sessions: map[string]Chain{},
+	}
+}
+
+// Observe records c as the latest state of session's conversation. If c does
+// not extend the previously observed chain, the conversation was rewound and
+// fork is the number of messages still shared with it.
+func (t *Tracker) Observe(session string, c Chain) (fork int, rewound bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	prev, ok := t.sessions[session]
+	t.sessions[session] = c
+	if !ok {
+		return len(c), false
+	}
+	fork = CommonPrefix(prev, c)
+	return fork, fork < len(prev)
+}
@@ -0,0 +1,135 @@
+package history
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func msgs(raw ...string) []json.RawMessage {
+	out := make([]json.RawMessage, len(raw))
+	for i, r := range raw {
+		out[i] = json.RawMessage(r)
+	}
+	return out
+}
+
+func mustChain(t *testing.T, raw ...string) Chain {
+	t.Helper()
+	c, err := NewChain(msgs(raw...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCanonicalize(t *testing.T) {
+	t.Run("IgnoresCacheControlAndKeyOrder", func(t *testing.T) {
+		a, err := Sum(json.RawMessage(`{"role":"user","content":[{"type":"text","text":"hi","cache_control":{"type":"ephemeral"}}]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Sum(json.RawMessage(`{"content":[{"text":"hi","type":"text"}],"role":"user"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a != b {
+			t.Errorf("expected equal hashes, got %s and %s", a, b)
+		}
+	})
+
+	t.Run("StringContentEqualsTextBlock", func(t *testing.T) {
+		a, _ := Sum(json.RawMessage(`{"role":"user","content":"hi"}`))
+		b, _ := Sum(json.RawMessage(`{"role":"user","content":[{"type":"text","text":"hi"}]}`))
+		if a != b {
+			t.Errorf("expected equal hashes, got %s and %s", a, b)
+		}
+	})
+
+	t.Run("KeepsNumbersExact", func(t *testing.T) {
+		b, err := Canonicalize(json.RawMessage(`{"n":12345678901234567890}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != `{"n":12345678901234567890}` {
+			t.Errorf("unexpected canonical form %s", b)
+		}
+	})
+
+	t.Run("InvalidJSON", func(t *testing.T) {
+		if _, err := NewChain(msgs(`{"role":`)); err == nil {
+			t.Error("expected error for invalid message")
+		}
+	})
+}
+
+func TestChain(t *testing.T) {
+	a := mustChain(t, `{"role":"user","content":"a"}`, `{"role":"assistant","content":"b"}`, `{"role":"user","content":"c"}`)
+	b := mustChain(t, `{"role":"user","content":"a"}`, `{"role":"assistant","content":"b"}`, `{"role":"user","content":"d"}`)
+	if n := CommonPrefix(a, b); n != 2 {
+		t.Errorf("expected common prefix 2, got %d", n)
+	}
+	if n := CommonPrefix(a, a[:1]); n != 1 {
+		t.Errorf("expected common prefix 1, got %d", n)
+	}
+	if n := CommonPrefix(a, nil); n != 0 {
+		t.Errorf("expected common prefix 0, got %d", n)
+	}
+
+	// Same message at a different position is a different conversation point.
+	c := mustChain(t, `{"role":"user","content":"c"}`)
+	if c[0] == a[2] {
+		t.Error("expected hash to depend on previous messages")
+	}
+
+	h, err := ParseHash(a.Head().String())
+	if err != nil || h != a.Head() {
+		t.Errorf("hash did not round trip: %v", err)
+	}
+	if !Chain(nil).Head().IsZero() {
+		t.Error("expected zero head for empty chain")
+	}
+}
+
+func TestTracker(t *testing.T) {
+	u1 := `{"role":"user","content":"one"}`
+	a1 := `{"role":"assistant","content":"done one"}`
+	u2 := `{"role":"user","content":"two"}`
+	a2 := `{"role":"assistant","content":"done two"}`
+	u3 := `{"role":"user","content":"three"}`
+
+	tr := NewTracker()
+
+	if _, rewound := tr.Observe("s", mustChain(t, u1)); rewound {
+		t.Fatal("first request cannot be a rewind")
+	}
+	if _, rewound := tr.Observe("s", mustChain(t, u1, a1, u2)); rewound {
+		t.Fatal("extending the conversation is not a rewind")
+	}
+
+	// Another session with unrelated messages does not interfere.
+	if _, rewound := tr.Observe("other", mustChain(t, `{"role":"user","content":"title?"}`)); rewound {
+		t.Fatal("unexpected rewind in other session")
+	}
+
+	if _, rewound := tr.Observe("s", mustChain(t, u1, a1, u2, a2, u3)); rewound {
+		t.Fatal("extending the conversation is not a rewind")
+	}
+
+	// Go back to before "three".
+	fork, rewound := tr.Observe("s", mustChain(t, u1, a1, u2, a2, `{"role":"user","content":"three, differently"}`))
+	if !rewound || fork != 4 {
+		t.Fatalf("expected rewind at 4, got %d %v", fork, rewound)
+	}
+
+	// Go back to before "two", without a tool_result anywhere in sight.
+	fork, rewound = tr.Observe("s", mustChain(t, u1, a1, `{"role":"user","content":"two, differently"}`))
+	if !rewound || fork != 2 {
+		t.Fatalf("expected rewind at 2, got %d %v", fork, rewound)
+	}
+
+	// Go back to the very first prompt.
+	fork, rewound = tr.Observe("s", mustChain(t, `{"role":"user","content":"one, differently"}`))
+	if !rewound || fork != 0 {
+		t.Fatalf("expected rewind at 0, got %d %v", fork, rewound)
+	}
+}
@@ -0,0 +1,174 @@
+// Package ignore decides which files of a directory tree to leave out, following
+// the .gitignore syntax.
+//
+// Rules come in two layers: the .gitignore files of the tree, and a .cosmosignore
+// file at its root whose rules win over them. A "!.env" line in .cosmosignore
+// brings back a file that .gitignore leaves out.
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher holds the rules read so far.
+type Matcher struct {
+	git, cosmos []rule
+}
+
+// AddGitignore adds the rules of a .gitignore file found in the directory base,
+// slash-separated and relative to the root ("" for the root itself). A missing
+// file adds nothing.
+func (m *Matcher) AddGitignore(name, base string) error {
+	rules, err := readRules(name, base)
+	m.git = append(m.git, rules...)
+	return err
+}
+
+// AddCosmosignore adds the rules of a .cosmosignore file at the root.
+func (m *Matcher) AddCosmosignore(name string) error {
+	rules, err := readRules(name, "")
+	m.cosmos = append(m.cosmos, rules...)
+	return err
+}
+
+func readRules(name, base string) ([]rule, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []rule
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if r, ok := parseRule(s.Text(), base); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, s.Err()
+}
+
+// parseRule parses a line of an ignore file in the directory base.
+func parseRule(line, base string) (rule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false
+	}
+	var r rule
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule{}, false
+	}
+	// A pattern with a slash other than at its end is relative to base, otherwise it matches at any depth.
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if base != "" {
+		sb.WriteString(regexp.QuoteMeta(base) + "/")
+	}
+	if !anchored {
+		sb.WriteString("(?:.*/)?")
+	}
+	sb.WriteString(globRegexp(line))
+	sb.WriteString("$")
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return rule{}, false
+	}
+	r.re = re
+	return r, true
+}
+
+// globRegexp translates a gitignore glob to a regular expression.
+func globRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				switch {
+				case strings.HasPrefix(glob[i:], "**/"):
+					// Any number of directories, none included.
+					sb.WriteString("(?:.*/)?")
+					i += 2
+				default:
+					sb.WriteString(".*")
+					i++
+				}
+				continue
+			}
+			sb.WriteString("[^/]*")
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			if j := strings.IndexByte(glob[i+1:], ']'); j >= 0 {
+				class := glob[i+1 : i+1+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+				i += j + 1
+				continue
+			}
+			sb.WriteString(`\[`)
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
+
+// Ignored reports whether the slash-separated path, relative to the root, is left
+// out. The files of an ignored directory are left out with it, whatever the rules
+// say about them.
+func (m *Matcher) Ignored(p string, isDir bool) bool {
+	p = path.Clean(p)
+	if ignored, ok := match(m.cosmos, p, isDir); ok {
+		return ignored
+	}
+	ignored, _ := match(m.git, p, isDir)
+	return ignored
+}
+
+// match returns the decision of the last rule matching p, if any.
+func match(rules []rule, p string, isDir bool) (ignored, ok bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		r := rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(p) {
+			return !r.negate, true
+		}
+	}
+	return false, false
+}
@@ -0,0 +1,63 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnored(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		name = filepath.Join(dir, name)
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return name
+	}
+	var m Matcher
+	if err := m.AddGitignore(write("root", "# comment\nnode_modules/\n*.log\n!keep.log\n/build\n.env*\ndocs/**/*.tmp\n"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddGitignore(write("sub", "generated.go\n/local\n"), "pkg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddCosmosignore(write("cosmos", "!.env.example\n*.mp4\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddGitignore(filepath.Join(dir, "missing"), "x"); err != nil {
+		t.Errorf("missing file: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"node_modules", false, false}, // only directories
+		{"debug.log", false, true},
+		{"logs/debug.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, false}, // anchored at the root
+		{".env", false, true},
+		{".env.local", false, true},
+		{".env.example", false, false}, // brought back by .cosmosignore
+		{"docs/a/b/x.tmp", false, true},
+		{"docs/x.tmp", false, true},
+		{"x.tmp", false, false},
+		{"pkg/generated.go", false, true},
+		{"pkg/sub/generated.go", false, true},
+		{"generated.go", false, false}, // outside of pkg
+		{"pkg/local", true, true},
+		{"pkg/sub/local", true, false},
+		{"video.mp4", false, true},
+		{"main.go", false, false},
+	} {
+		if got := m.Ignored(tc.path, tc.isDir); got != tc.want {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", tc.path, tc.isDir, got, tc.want)
+		}
+	}
+}
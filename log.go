@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// cmdLog lists the snapshots of the project in the current directory, newest first.
+func cmdLog(args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	graph := fs.Bool("graph", false, "draw the snapshot tree with its branches")
+	verbose := fs.Bool("v", false, "show the whole snapshot messages, and the output of failed verifications")
+	passed := fs.Bool("passed", false, "only show the snapshots whose verification passed")
+	fs.Parse(args)
+
+	workdir := M2(os.Getwd())
+	tree := M2(loadState()).Project(workdir)
+	if len(tree.Snapshots) == 0 {
+		fmt.Fprintln(os.Stderr, "no snapshots for", workdir)
+		return
+	}
+
+	format := func(s *snapshot.Snapshot) string {
+		var tags string
+		if len(s.Tags) > 0 {
+			tags = " (" + strings.Join(s.Tags, ", ") + ")"
+		}
+		var verify string
+		if s.Verify != nil {
+			verify = " [" + s.Verify.String() + "]"
+		}
+		return fmt.Sprintf("%s%s %s%s %s", snapshot.Short(s.ID), tags, s.Created.Local().Format(time.DateTime), verify, s.Summary())
+	}
+	if *graph {
+		M(tree.Graph(os.Stdout, format))
+		return
+	}
+	for i := len(tree.Snapshots) - 1; i >= 0; i-- {
+		s := tree.Snapshots[i]
+		if *passed && (s.Verify == nil || !s.Verify.Passed()) {
+			continue
+		}
+		fmt.Println(format(s))
+		if *verbose {
+			_, details, _ := strings.Cut(s.Message, "\n")
+			for _, line := range strings.Split(strings.TrimSpace(details), "\n") {
+				fmt.Println("    " + line)
+			}
+			if v := s.Verify; v != nil {
+				fmt.Printf("\n    Verify: %s %s in %v\n", v.Command, v, v.Duration.Round(time.Millisecond))
+				if !v.Passed() {
+					for _, line := range strings.Split(v.Output, "\n") {
+						fmt.Println("      " + line)
+					}
+				}
+			}
+			fmt.Println()
+		}
+	}
+}
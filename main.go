@@ -8,57 +8,145 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/mattn/go-isatty"
+	"github.com/tiborvass/cosmos/policy"
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/store"
+	"github.com/tiborvass/cosmos/tracing"
 	. "github.com/tiborvass/cosmos/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sys/unix"
 )
 
-var logFile *os.File
+var (
+	logFile *os.File
+	tracer  = otel.Tracer("github.com/tiborvass/cosmos")
+
+	// shutdownTracing flushes pending spans, it must be called before exiting or reexecuting.
+	shutdownTracing = func(context.Context) error { return nil }
+)
 
 func init() {
-	logFile, _ = os.Create("/tmp/cosmos.log")
+	// Sessions log to their directory, commands don't log.
+	logFile, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 }
 
 func usage() {
-	fmt.Fprintln(os.Stderr, "usage: cosmos <coding-agent> [<coding-agent-option>...]")
+	fmt.Fprintln(os.Stderr, "usage: cosmos [<option>...] <coding-agent> [<coding-agent-option>...]")
+	fmt.Fprintln(os.Stderr, "       cosmos <command> [<command-option>...]")
 	fmt.Fprintln(os.Stderr, "coding-agent: only \"claude\" is currently supported")
+	fmt.Fprintln(os.Stderr, "command: attach, diff, export, fanout, fsck, gc, log, logs, ps, squash, tag, transcript")
+	fmt.Fprintln(os.Stderr, "options:")
+	fmt.Fprintln(os.Stderr, "  --snapshot=turn|tool  snapshot at the end of each turn (default), or after each tool call that changed files")
+	fmt.Fprintln(os.Stderr, "  --policy=<file>       allow, deny, snapshot before or ask about tool calls according to the rules in file")
+	fmt.Fprintln(os.Stderr, "  --network=full|allowlist|none")
+	fmt.Fprintln(os.Stderr, "                        let the agent reach anything (default), only the --allow domains, or only the API")
+	fmt.Fprintln(os.Stderr, "  --allow=<domain>      domain reachable with its subdomains in allowlist mode, can be repeated")
+	fmt.Fprintln(os.Stderr, "  --deny=<domain>       domain never reachable with its subdomains, can be repeated")
+	fmt.Fprintln(os.Stderr, "  --mitm=<domain>       decrypt and log the HTTPS requests to domain and its subdomains, can be repeated")
+	fmt.Fprintln(os.Stderr, "  --snapshot-backend=docker|git|store")
+	fmt.Fprintln(os.Stderr, "                        snapshot the whole container (default), commit the workdir to refs/cosmos/ in its repository,")
+	fmt.Fprintln(os.Stderr, "                        or record the workdir in the content-addressed store of the cosmos directory")
+	fmt.Fprintln(os.Stderr, "  --verify=<command>    run command in the workdir after the snapshot of each turn, e.g. \"go test ./...\"")
+	fmt.Fprintln(os.Stderr, "  --squash-layers=<n>   squash snapshot images once they have n layers (default 100, 0 for never)")
+	fmt.Fprintln(os.Stderr, "  --mount-mode=copy|bind|overlay")
+	fmt.Fprintln(os.Stderr, "                        copy the workdir into the container (default), mount it, or mount it under a writable layer")
+	fmt.Fprintln(os.Stderr, "  --cpus=<n>            CPUs the container can use")
+	fmt.Fprintln(os.Stderr, "  --memory=<size>       memory the container can use, e.g. 4g")
+	fmt.Fprintln(os.Stderr, "  --pids-limit=<n>      processes the container can run (default 0, no limit)")
+	fmt.Fprintln(os.Stderr, "  --read-only           read-only root filesystem with scratch tmpfs, which disables docker snapshots")
+	fmt.Fprintln(os.Stderr, "  --cap-drop=<cap>      capability to drop, ALL for all but those cosmos needs, can be repeated")
+	fmt.Fprintln(os.Stderr, "  --seccomp=<file>      seccomp profile of the container")
+	fmt.Fprintln(os.Stderr, "  --no-new-privileges   keep processes from gaining privileges")
 }
 
-type Snapshot struct {
-	ID        string
-	Message   string
-	SessionID string
+var commands = map[string]func(args []string){
+	"attach":     cmdAttach,
+	"diff":       cmdDiff,
+	"export":     cmdExport,
+	"fanout":     cmdFanout,
+	"fsck":       cmdFsck,
+	"gc":         cmdGC,
+	"log":        cmdLog,
+	"logs":       cmdLogs,
+	"ps":         cmdPs,
+	"squash":     cmdSquash,
+	"tag":        cmdTag,
+	"transcript": cmdTranscript,
 }
 
-var state struct {
-	Projects map[string]struct {
-		Snapshots []Snapshot
-	}
+// session is the agent run managed by this process. It survives reexecs through the environment.
+type session struct {
+	ID        string
+	Workdir   string
+	Container string
+	Head      string // last snapshot of the current branch, empty before the first one
+
+	// Fingerprint is the container filesystem state at the last snapshot.
+	Fingerprint string
+
+	// GitBase is the commit of the workdir when the session started, uncommitted
+	// changes included, if the workdir is in a repository and the backend is git.
+	GitBase string
+	// With the git backend, the snapshots are commits in repo, the first one on top of GitBase.
+	repo *gitRepo
+	// With the store backend, the snapshots are manifests in store.
+	store *store.Store
+	// headless sessions run a single prompt for cosmos fanout, there is no process to reexec.
+	headless bool
 }
 
-var imgs = []string{"cosmos"}
-
-func manage(ctx context.Context, clientID string, conn net.Conn) {
+func manage(ctx context.Context, sess *session, conn net.Conn) {
+	clientID := sess.Container
 	defer func() {
 		fmt.Fprintln(logFile, "Closing conn")
 		conn.Close()
 	}()
 	d := json.NewDecoder(conn)
 	d.UseNumber()
-	var x struct {
-		Action string
-		Data   json.RawMessage
+	// The proxy waits for the replies to the messages with an ID.
+	var mReply sync.Mutex
+	replies := json.NewEncoder(conn)
+	reply := func(id uint64, data any, err error) {
+		if id == 0 {
+			return
+		}
+		r := struct {
+			ID    uint64
+			Data  any
+			Error string `json:",omitempty"`
+		}{ID: id, Data: data}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		mReply.Lock()
+		defer mReply.Unlock()
+		if err := replies.Encode(r); err != nil {
+			fmt.Fprintln(logFile, "reply:", err)
+		}
 	}
 	for {
+		var x struct {
+			ID     uint64
+			Action string
+			Data   json.RawMessage
+			Trace  map[string]string
+		}
 		if err := d.Decode(&x); err != nil {
 			if errors.Is(err, io.EOF) {
 				fmt.Fprintln(logFile, "EOF")
@@ -66,28 +154,158 @@ func manage(ctx context.Context, clientID string, conn net.Conn) {
 			}
 			panic(err)
 		}
+		ctx, span := tracer.Start(tracing.Extract(ctx, x.Trace), "manager."+x.Action, trace.WithSpanKind(trace.SpanKindServer))
 		switch x.Action {
 		case "commit":
+			var data struct {
+				Message   string
+				Hash      string
+				IfChanged bool
+				EndTurn   bool
+				Turn      *snapshot.Turn
+			}
+			M(json.Unmarshal([]byte(x.Data), &data))
+			if opts.Sandbox.ReadOnly && opts.SnapshotBackend == backendDocker {
+				// The workdir and home are volumes, a commit would hold none of the agent's work.
+				fmt.Fprintln(logFile, "Read-only root filesystem, skipping", data.Message)
+				reply(x.ID, struct{ Snapshot string }{}, nil)
+				break
+			}
+			if opts.Snapshot == "tool" {
+				fp, err := fsFingerprint(ctx, clientID)
+				if err != nil {
+					fmt.Fprintln(logFile, "fingerprint:", err)
+				} else if data.IfChanged && fp == sess.Fingerprint {
+					fmt.Fprintln(logFile, "No changes since last snapshot, skipping", data.Message)
+					reply(x.ID, struct{ Snapshot string }{}, nil)
+					break
+				}
+				sess.Fingerprint = fp
+			}
 			bytes := make([]byte, 16)
 			M2(rand.Read(bytes))
 			snapshotID := hex.EncodeToString(bytes)
-			// TODO: check if image exists
 			fmt.Fprintln(logFile, "Snapshotting...")
-			var data string
-			M(json.Unmarshal([]byte(x.Data), &data))
-			imgID := R(ctx, "docker commit -m %q %s cosmos:%s", data, clientID, snapshotID)
-			fmt.Fprintln(logFile, "Snapshot", snapshotID, "image", imgID)
-			imgs = append(imgs, imgID)
+			snap := &snapshot.Snapshot{
+				ID:        snapshotID,
+				Parent:    sess.Head,
+				Hash:      data.Hash,
+				Message:   data.Message,
+				SessionID: sess.ID,
+				Created:   time.Now(),
+				Turn:      data.Turn,
+				Base:      sess.GitBase,
+			}
+			if opts.SnapshotBackend == backendGit {
+				_, gspan := tracer.Start(ctx, "git.commit", trace.WithAttributes(attribute.String("snapshot", snapshotID)))
+				commit, ref, err := sess.repo.commit(ctx, sess, gitParent(M2(loadState()).Project(sess.Workdir), sess), data.Message)
+				gspan.End()
+				if err != nil {
+					fmt.Fprintln(logFile, "git snapshot:", err)
+					reply(x.ID, nil, err)
+					break
+				}
+				if err := saveClaudeState(ctx, clientID, snapshotID); err != nil {
+					fmt.Fprintln(logFile, err)
+				}
+				snap.Commit, snap.Ref = commit, ref
+				fmt.Fprintln(logFile, "Snapshot", snapshotID, "commit", commit, ref)
+			} else if opts.SnapshotBackend == backendStore {
+				_, sspan := tracer.Start(ctx, "store.snapshot", trace.WithAttributes(attribute.String("snapshot", snapshotID)))
+				manifest, claude, err := storeSnapshot(ctx, sess.store, clientID, sess.Workdir, M2(loadState()).Project(sess.Workdir).Get(sess.Head))
+				sspan.End()
+				if err != nil {
+					fmt.Fprintln(logFile, "store snapshot:", err)
+					reply(x.ID, nil, err)
+					break
+				}
+				snap.Manifest, snap.ClaudeManifest = manifest, claude
+				fmt.Fprintln(logFile, "Snapshot", snapshotID, "manifest", manifest)
+			} else {
+				// TODO: check if image exists
+				if err := dockerSnapshot(ctx, sess, snap); err != nil {
+					// Not recorded, a load can't run an image that doesn't exist.
+					fmt.Fprintln(logFile, err)
+					reply(x.ID, nil, err)
+					break
+				}
+				fmt.Fprintln(logFile, "Snapshot", snapshotID, "image", snap.Image)
+			}
+			if opts.Mount == mountBind && opts.SnapshotBackend == backendDocker {
+				// The bind-mounted workdir is not in the image.
+				if err := archiveWorkdir(sess, snap.ID); err != nil {
+					fmt.Fprintln(logFile, "archiving workdir:", err)
+				} else {
+					snap.WorkdirArchive = true
+				}
+			}
+			// Fanout runs are tested once done, their container is gone by then.
+			verifying := opts.Verify != "" && data.EndTurn && !sess.headless
+			if verifying && !verifyInImage(snap) {
+				// Before replying, while the turn is over and the workdir is still the snapshot's.
+				verifySnapshot(ctx, sess, snap)
+			}
+			M(updateState(func(st *State) error {
+				st.Project(sess.Workdir).Add(snap)
+				return nil
+			}))
+			sess.Head = snap.ID
+			os.Setenv("COSMOS_HEAD", sess.Head)
+			reply(x.ID, struct{ Snapshot string }{snap.ID}, nil)
+			if verifying && verifyInImage(snap) {
+				go verifyImage(ctx, sess, snap)
+			}
+		case "ask":
+			var req policy.ApprovalRequest
+			M(json.Unmarshal([]byte(x.Data), &req))
+			// The stream waiting for approval doesn't hold up the other messages.
+			go func(id uint64) {
+				reply(id, approve(ctx, req), nil)
+			}(x.ID)
+		case "egress":
+			fmt.Fprintln(logFile, "egress", string(x.Data))
+			if err := logEvent(sess, "egress", x.Data); err != nil {
+				fmt.Fprintln(logFile, "logging event:", err)
+			}
 		case "load":
+			if sess.headless {
+				fmt.Fprintln(logFile, "load", "ignored in headless session", sess.ID)
+				break
+			}
 			var data struct {
-				N      int
+				Hashes []string
 				Prompt string
 			}
 			M(json.Unmarshal([]byte(x.Data), &data))
-			n := data.N
-			prompt := data.Prompt
-			fmt.Fprintln(logFile, "load", "n", n)
-			imgID := imgs[n]
+			st := M2(loadState())
+			// Restarting from an earlier snapshot starts a new branch, the snapshots after it stay in the tree.
+			target := st.Project(sess.Workdir).RestorePoint(sess.Head, data.Hashes)
+			// A snapshot whose image or files are gone falls back to the one it was taken on top of.
+			for target != nil {
+				err := checkSnapshot(ctx, sess.Workdir, target, false)
+				if err == nil {
+					break
+				}
+				fmt.Fprintln(logFile, "load", "snapshot", target.ID, "can't be restored, falling back to its parent:", err)
+				target = st.Project(sess.Workdir).Get(target.Parent)
+			}
+			if target != nil && opts.SnapshotBackend != backendDocker {
+				// A fresh container gets the workdir and claude's sessions of the snapshot.
+				fmt.Fprintln(logFile, "load", "snapshot", target.ID, "commit", target.Commit, "manifest", target.Manifest)
+				os.Setenv("COSMOS_RESTORE", target.ID)
+				os.Setenv("COSMOS_HEAD", target.ID)
+			} else if target != nil {
+				fmt.Fprintln(logFile, "load", "snapshot", target.ID)
+				os.Setenv("IMAGE", target.Image)
+				os.Setenv("COSMOS_HEAD", target.ID)
+			} else {
+				// Back to before the first snapshot: start over from a fresh copy of the workdir.
+				fmt.Fprintln(logFile, "load", "initial image")
+				os.Unsetenv("IMAGE")
+				os.Unsetenv("COSMOS_RESTORE")
+				os.Unsetenv("COSMOS_HEAD")
+			}
+			os.Setenv("CLAUDE_PROMPT", data.Prompt)
 			conn.Close()
 			done := make(chan struct{})
 			go func() {
@@ -99,41 +317,96 @@ func manage(ctx context.Context, clientID string, conn net.Conn) {
 			}()
 			fmt.Fprintln(logFile, "waiting for container", clientID, "to shutdown")
 			exec.Command("docker", "wait", clientID).Run()
-			fmt.Fprintln(logFile, "load", "image", imgID)
-			env := append(os.Environ(), "IMAGE="+imgID, "N="+string(n+1), "CLAUDE_PROMPT="+prompt)
-			err := syscall.Exec(os.Args[0], os.Args, env)
+			// The next container of the session takes its name.
+			if out, err := exec.Command("docker", "rm", clientID).CombinedOutput(); err != nil {
+				fmt.Fprintf(logFile, "docker rm: %v: %s\n", err, out)
+			}
+			switch {
+			case opts.Mount == mountBind && opts.SnapshotBackend == backendGit:
+				commit := sess.GitBase
+				if target != nil {
+					commit = target.Commit
+				}
+				if commit != "" {
+					if err := sess.repo.restore(ctx, sess, commit); err != nil {
+						fmt.Fprintln(logFile, "restoring workdir:", err)
+					}
+				}
+			case opts.Mount == mountBind:
+				if err := restoreWorkdir(sess, st.Project(sess.Workdir), target); err != nil {
+					fmt.Fprintln(logFile, "restoring workdir:", err)
+				}
+			}
+			span.End()
+			shutdownTracing(ctx)
+			if tty != nil {
+				tty.Close()
+			}
+			err := syscall.Exec(os.Args[0], os.Args, os.Environ())
 			panic(err)
 		}
+		span.End()
+	}
+}
+
+// dockerSnapshot commits the container of the session to the image of snap,
+// tagged cosmos:<id>, and squashes it when it has too many layers.
+func dockerSnapshot(ctx context.Context, sess *session, snap *snapshot.Snapshot) error {
+	_, span := tracer.Start(ctx, "docker.commit", trace.WithAttributes(attribute.String("snapshot", snap.ID)))
+	commitArgs := []string{"docker", "commit", "-m", snap.Message}
+	labels := snapshotLabels(sess, snap, len(M2(loadState()).Project(sess.Workdir).Ancestors(snap.Parent))+1)
+	if snap.Turn != nil {
+		maps.Copy(labels, snap.Turn.Labels())
+	}
+	for _, k := range slices.Sorted(maps.Keys(labels)) {
+		commitArgs = append(commitArgs, "-c", fmt.Sprintf("LABEL %s=%s", k, strconv.Quote(labels[k])))
+	}
+	out, err := exec.CommandContext(ctx, commitArgs[0], append(commitArgs[1:], sess.Container, "cosmos:"+snap.ID)...).CombinedOutput()
+	span.End()
+	if err != nil {
+		return fmt.Errorf("docker commit: %w: %s", err, out)
+	}
+	snap.Image = strings.TrimSpace(string(out))
+	// Every load runs the latest image and commits on top of it, overlay has a limit of layers.
+	if layers, err := imageLayers(ctx, snap.Image); err != nil {
+		fmt.Fprintln(logFile, "layers:", err)
+	} else if opts.SquashLayers > 0 && layers >= opts.SquashLayers {
+		_, qspan := tracer.Start(ctx, "docker.squash", trace.WithAttributes(attribute.String("snapshot", snap.ID), attribute.Int("layers", layers)))
+		if image, err := squashImage(ctx, snap.Image, "cosmos:"+snap.ID, snap.Message); err != nil {
+			fmt.Fprintln(logFile, "squashing:", err)
+		} else {
+			fmt.Fprintln(logFile, "Squashed", layers, "layers of", snap.Image, "into", image)
+			snap.Image = image
+		}
+		qspan.End()
 	}
+	return nil
 }
 
 func main() {
-	if len(os.Args) <= 1 {
+	rest := parseOptions(os.Args[1:])
+	if len(rest) == 0 {
 		usage()
 		os.Exit(1)
 	}
 
-	codingAgent := os.Args[1]
+	if cmd, ok := commands[rest[0]]; ok {
+		cmd(rest[1:])
+		return
+	}
+
+	codingAgent := rest[0]
 
 	if codingAgent != "claude" {
 		usage()
 		os.Exit(1)
 	}
 
-	args := os.Args[2:]
+	args := rest[1:]
 
-	cosmosDir := filepath.Join(M2(os.UserConfigDir()), ".cosmos")
-	cosmosLogDir := filepath.Join(cosmosDir, "containerlogs")
 	os.MkdirAll(cosmosDir, 0755)
 
-	stateFile, err := os.Open(filepath.Join(cosmosDir, "state.json"))
-	if err == nil {
-		M(json.NewDecoder(stateFile).Decode(&state))
-	} else if !os.IsNotExist(err) {
-		panic(err)
-	}
-
-	img := imgs[0]
+	img := "cosmos"
 	resume := ""
 	IMAGE := os.Getenv("IMAGE")
 	if IMAGE != "" {
@@ -142,14 +415,64 @@ func main() {
 	}
 	// panic("resume: " + resume)
 	workdir := M2(os.Getwd())
-	/*
-		if project, ok := state.Projects[workdir]; ok && len(project.Snapshots) > 0 {
-			img = project.Snapshots[len(project.Snapshots)-1].ID
+
+	sess := &session{
+		ID:      os.Getenv("COSMOS_SESSION"),
+		Workdir: workdir,
+		Head:    os.Getenv("COSMOS_HEAD"),
+	}
+	if sess.ID == "" {
+		bytes := make([]byte, 8)
+		M2(rand.Read(bytes))
+		sess.ID = hex.EncodeToString(bytes)
+		os.Setenv("COSMOS_SESSION", sess.ID)
+	}
+	// The session directory gets the host log, the events and the container logs.
+	cosmosLogDir := sessionDir(sess.ID)
+	M(os.MkdirAll(cosmosLogDir, 0755))
+	logFile = M2(os.OpenFile(filepath.Join(cosmosLogDir, "cosmos.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644))
+	fmt.Fprintln(logFile, "session", sess.ID, "head", sess.Head)
+
+	// With the git and store backends, the snapshot to restore in a fresh container.
+	restore := os.Getenv("COSMOS_RESTORE")
+	if restore != "" {
+		resume = "-c"
+	}
+	switch opts.SnapshotBackend {
+	case backendGit:
+		repo, err := openGitRepo(workdir, sess.ID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "--snapshot-backend=git:", err)
+			os.Exit(1)
 		}
-	*/
+		sess.repo = repo
+	case backendStore:
+		sess.store = M2(store.Open(storeDir))
+	}
+	// With the git backend, exports diff the snapshots of the session against
+	// where it started, and going back to before the first snapshot restores it.
+	// The other backends leave it to exports to resolve HEAD.
+	sess.GitBase = os.Getenv("COSMOS_GIT_BASE")
+	if sess.GitBase == "" && opts.SnapshotBackend == backendGit {
+		base, err := startCommit(context.Background(), workdir, sess.ID)
+		if err != nil {
+			fmt.Fprintln(logFile, "recording the start of the session:", err)
+			base = headCommit(workdir)
+		}
+		sess.GitBase = base
+		os.Setenv("COSMOS_GIT_BASE", sess.GitBase)
+	}
+	M(saveSessionInfo(sess))
 
 	ctx := context.Background()
 
+	if shutdown, err := tracing.Init(ctx, "cosmos"); err != nil {
+		fmt.Fprintln(logFile, "tracing disabled:", err)
+	} else {
+		shutdownTracing = shutdown
+		defer shutdownTracing(ctx)
+	}
+
 	// Read claude configuration
 	// claudeJSONBytes := M2(os.ReadFile("/tmp/claude.json"))
 	// var claudeJSON map[string]any
@@ -167,29 +490,36 @@ func main() {
 	prompt := os.Getenv("CLAUDE_PROMPT")
 	fmt.Fprintln(logFile, "prompt", prompt)
 
-	// Build docker run command for the combined container
-	// dockerArgs := fmt.Sprintf("docker run --init --rm -v %s:%s -v /tmp/claude.json:/root/.claude.json -v /tmp/claude.state/.credentials.json:/root/.claude/.credentials.json -w %s -e CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC=1 cosmos", workdir, workdir, workdir)
-
-	home := M2(os.UserHomeDir())
-	claudeJsonPath := filepath.Join(home, ".claude.json")
-	credentialsJsonPath := filepath.Join(home, ".credentials.json")
-	exec.Command("touch", claudeJsonPath).Run()
-	exec.Command("touch", credentialsJsonPath).Run()
-
-	dockerArgs := fmt.Sprintf("docker run -d --init -P -h cosmos -v %q:/cosmos -w %q -v %s:/home/cosmos/.claude.json -v %s:/home/cosmos/.claude/.credentials.json -e CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC=1 %q --dangerously-skip-permissions %s", cosmosLogDir, workdir, claudeJsonPath, credentialsJsonPath, img, resume)
-	// dockerArgs := fmt.Sprintf("docker run -d --init -P --rm -h cosmos --tmpfs /cosmos -v %s:/%s -w %s -v /tmp/claude.state/.credentials.json:/home/cosmos/.claude/.credentials.json -e CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC=1 %s", workdir, workdir, workdir, img)
-
-	// Add -it if we have a TTY
-	if isatty.IsTerminal(os.Stdin.Fd()) {
-		dockerArgs = strings.Replace(dockerArgs, "docker run ", "docker run -it ", 1)
+	// The files to copy are listed before the container starts, to report how much it is.
+	var seed []string
+	if IMAGE == "" && restore == "" && opts.Mount == mountCopy {
+		paths, files, size, err := seedFiles(workdir)
+		M(err)
+		seed = paths
+		fmt.Fprintf(os.Stderr, "cosmos: copying %d files (%s) of %s into the container\n", files, formatSize(size), workdir)
+		fmt.Fprintln(logFile, "seeding", files, "files,", size, "bytes")
 	}
 
-	shArgs := dockerArgs + " " + strings.Join(args, " ") + fmt.Sprintf(" %q", prompt)
+	shArgs := dockerRun(sess, img, isatty.IsTerminal(os.Stdin.Fd()), resume) + " " + strings.Join(args, " ") + fmt.Sprintf(" %q", prompt)
 
 	fmt.Fprintln(logFile, "exec", shArgs)
 
 	// Run the container directly with stdin/stdout/stderr attached
 	clientID := R(ctx, shArgs)
+	sess.Container = clientID
+	if applied, err := inspectSandbox(ctx, clientID); err != nil {
+		fmt.Fprintln(logFile, "sandbox:", err)
+	} else {
+		if err := recordSandbox(sess, applied); err != nil {
+			fmt.Fprintln(logFile, "sandbox:", err)
+		}
+		if err := logEvent(sess, "sandbox", M2(json.Marshal(struct {
+			Options sandbox
+			Applied *appliedSandbox
+		}{opts.Sandbox, applied}))); err != nil {
+			fmt.Fprintln(logFile, "logging event:", err)
+		}
+	}
 
 	// Not needed if docker run --rm ?
 	// defer func() {
@@ -199,11 +529,18 @@ func main() {
 	// Create a channel to receive OS signals.
 	sigs := make(chan os.Signal, 1)
 	// Notify the channel on SIGINT (Ctrl+C) or SIGTERM
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGINFO)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGQUIT, syscall.SIGHUP, syscall.SIGINFO, syscall.SIGWINCH)
 
 	go func() {
 		for {
 			sig := <-sigs
+			if sig == syscall.SIGWINCH {
+				// docker attach resizes the container's terminal when its own is resized.
+				if tty != nil {
+					tty.Resize()
+				}
+				continue
+			}
 			if sig, ok := sig.(syscall.Signal); ok {
 				name := unix.SignalName(sig)
 				fmt.Fprintln(logFile, "received signal", name, int(sig), ":", sig.String())
@@ -218,15 +555,131 @@ func main() {
 	clientAddr := R(ctx, "docker port %s %s/tcp", clientID, clientPort)
 
 	// Only copy workdir if we're not reexecuting.
-	if IMAGE == "" {
-		R(ctx, "docker cp %q %q:%q", workdir, clientID, workdir)
+	if restore != "" && opts.SnapshotBackend == backendStore {
+		snap := M2(loadState()).Project(workdir).Get(restore)
+		M(restoreFromStore(ctx, sess.store, clientID, workdir, snap))
+	} else if restore != "" {
+		snap := M2(loadState()).Project(workdir).Get(restore)
+		if opts.Mount != mountBind {
+			M(sess.repo.restore(ctx, sess, snap.Commit))
+		}
+		if err := restoreClaudeState(ctx, clientID, restore); err != nil {
+			fmt.Fprintln(logFile, "restoring claude's sessions:", err)
+		}
+	} else if IMAGE == "" && opts.Mount == mountCopy {
+		M(seedWorkdir(ctx, clientID, workdir, seed))
 		R(ctx, "docker exec -u root %q chown -R cosmos:cosmos %q", clientID, workdir)
 	}
+	if opts.Snapshot == "tool" {
+		// Tool calls that don't change anything from here on are not worth a snapshot.
+		fp, err := fsFingerprint(ctx, clientID)
+		if err != nil {
+			fmt.Fprintln(logFile, "fingerprint:", err)
+		}
+		sess.Fingerprint = fp
+	}
+
+	conn := connectManager(ctx, clientID, clientAddr)
+	go manage(ctx, sess, conn)
+
+	cmd := exec.CommandContext(ctx, "docker", "attach", clientID)
+	// NOTE: i think this is useless if it's supposed to be called manually.
+	cmd.Cancel = func() error {
+		fmt.Fprintln(logFile, "cancelling", clientID)
+		return nil
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd()) {
+		// Relay the terminal so that cosmos can prompt the user too.
+		var err error
+		if tty, err = newTerminal(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(logFile, "terminal:", err)
+		} else {
+			defer tty.Close()
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = tty.pts, tty.pts, tty.pts
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+		}
+	}
 
+	if err := cmd.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// dockerRun returns the shell command starting the container of the session
+// from img, with claude's arguments, quoted for the shell.
+func dockerRun(sess *session, img string, interactive bool, claudeArgs string) string {
+	// Build docker run command for the combined container
+	// dockerArgs := fmt.Sprintf("docker run --init --rm -v %s:%s -v /tmp/claude.json:/root/.claude.json -v /tmp/claude.state/.credentials.json:/root/.claude/.credentials.json -w %s -e CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC=1 cosmos", workdir, workdir, workdir)
+
+	home := M2(os.UserHomeDir())
+	claudeJsonPath := filepath.Join(home, ".claude.json")
+	credentialsJsonPath := filepath.Join(home, ".credentials.json")
+	exec.Command("touch", claudeJsonPath).Run()
+	exec.Command("touch", credentialsJsonPath).Run()
+
+	dockerArgs := fmt.Sprintf("docker run -d --init -P -h cosmos -v %q:/cosmos -w %q -v %s:/home/cosmos/.claude.json -v %s:/home/cosmos/.claude/.credentials.json -e CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC=1 %q --dangerously-skip-permissions %s", sessionDir(sess.ID), sess.Workdir, claudeJsonPath, credentialsJsonPath, img, claudeArgs)
+	// dockerArgs := fmt.Sprintf("docker run -d --init -P --rm -h cosmos --tmpfs /cosmos -v %s:/%s -w %s -v /tmp/claude.state/.credentials.json:/home/cosmos/.claude/.credentials.json -e CLAUDE_CODE_DISABLE_NONESSENTIAL_TRAFFIC=1 %s", workdir, workdir, workdir, img)
+
+	// Add -it if we have a TTY
+	if interactive {
+		dockerArgs = strings.Replace(dockerArgs, "docker run ", "docker run -it ", 1)
+	}
+
+	// The commands find the container of a session by its name or labels.
+	runArgs := []string{"--name", containerName(sess.ID), "--label", "cosmos.session=" + sess.ID, "--label", fmt.Sprintf("%q", "cosmos.project="+sess.Workdir)}
+	runArgs = append(runArgs, "-e", "COSMOS_SNAPSHOT="+opts.Snapshot)
+	// Proxy spans go to the host's collector, or next to the container logs when tracing to a file.
+	runArgs = append(runArgs, tracing.DockerEnvArgs()...)
+	if os.Getenv(tracing.FileEnv) != "" {
+		runArgs = append(runArgs, "-e", tracing.FileEnv+"=/cosmos/proxy-traces.json")
+	}
+	if opts.Policy != "" {
+		runArgs = append(runArgs, "-v", fmt.Sprintf("%q", opts.Policy+":/etc/cosmos/policy.json:ro"), "-e", "COSMOS_POLICY=/etc/cosmos/policy.json")
+	}
+	// The proxy needs root for the firewall, the trust store and the overlay, and runs claude as the cosmos user.
+	runArgs = append(runArgs, "-u", "root")
+	if len(opts.MITM) > 0 {
+		runArgs = append(runArgs, "-e", fmt.Sprintf("%q", "COSMOS_MITM="+strings.Join(opts.MITM, ",")))
+	}
+	// The firewall reports the connections going around the proxy, and outside of
+	// the full mode keeps them from getting anywhere.
+	runArgs = append(runArgs, "--cap-add", "NET_ADMIN", "-e", "COSMOS_NETWORK="+opts.Network)
+	if opts.Network != "full" {
+		if len(opts.Allow) > 0 {
+			runArgs = append(runArgs, "-e", fmt.Sprintf("%q", "COSMOS_ALLOW="+strings.Join(opts.Allow, ",")))
+		}
+	}
+	if len(opts.Deny) > 0 {
+		runArgs = append(runArgs, "-e", fmt.Sprintf("%q", "COSMOS_DENY="+strings.Join(opts.Deny, ",")))
+	}
+	switch opts.Mount {
+	case mountCopy:
+		runArgs = append(runArgs, opts.Sandbox.dockerArgs(sess.Workdir)...)
+	case mountBind:
+		M(scanBase(sess))
+		runArgs = append(runArgs, "-v", fmt.Sprintf("%q", sess.Workdir+":"+sess.Workdir))
+		runArgs = append(runArgs, opts.Sandbox.dockerArgs("")...)
+	case mountOverlay:
+		// The proxy mounts the overlay with fuse-overlayfs, as root.
+		runArgs = append(runArgs, "-v", fmt.Sprintf("%q", sess.Workdir+":"+overlayLower+":ro"), "-e", "COSMOS_MOUNT=overlay",
+			"--device", "/dev/fuse", "--cap-add", "SYS_ADMIN", "--security-opt", "apparmor=unconfined")
+		runArgs = append(runArgs, opts.Sandbox.dockerArgs("")...)
+	}
+	dockerArgs = strings.Replace(dockerArgs, "docker run ", "docker run "+strings.Join(runArgs, " ")+" ", 1)
+	return dockerArgs
+}
+
+// connectManager connects to the manager port of the proxy in the container,
+// which holds claude back until then.
+func connectManager(ctx context.Context, clientID, clientAddr string) net.Conn {
 	fmt.Fprintln(logFile, "connecting to client", clientAddr)
 	dialer := &net.Dialer{}
 	var (
 		conn net.Conn
+		err  error
 	)
 
 	maxRetries := 5
@@ -244,20 +697,5 @@ func main() {
 	if err != nil {
 		panic(fmt.Errorf("failed to connect after %d retries: %v", maxRetries, err))
 	}
-
-	go manage(ctx, clientID, conn)
-
-	cmd := exec.CommandContext(ctx, "docker", "attach", clientID)
-	// NOTE: i think this is useless if it's supposed to be called manually.
-	cmd.Cancel = func() error {
-		fmt.Fprintln(logFile, "cancelling", clientID)
-		return nil
-	}
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		panic(err)
-	}
+	return conn
 }
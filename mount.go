@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// Mount modes of the workdir.
+const (
+	mountCopy    = "copy"    // copied into the container, snapshots commit it with the container
+	mountBind    = "bind"    // the host workdir itself, snapshots archive the files changed since the previous one
+	mountOverlay = "overlay" // the host workdir read-only, under a writable layer in the container that snapshots commit
+)
+
+// overlayLower is where the proxy finds the host workdir in overlay mode.
+const overlayLower = "/mnt/cosmos-lower"
+
+// workdirsDir holds the archives and manifests of the workdir snapshots in bind mode.
+var workdirsDir = filepath.Join(cosmosDir, "workdirs")
+
+func manifestPath(id string) string { return filepath.Join(workdirsDir, id+".json") }
+func archivePath(id string) string  { return filepath.Join(workdirsDir, id+".tar.gz") }
+
+// baseManifest is the workdir of a session before its first snapshot. baseArchive
+// holds the files git doesn't have as they were then, baseBlobs the git blobs of
+// the others until a snapshot sees them changed and archives them.
+func baseManifest(sess *session) string { return manifestPath("base-" + sess.ID) }
+func baseArchive(sess *session) string  { return archivePath("base-" + sess.ID) }
+func baseBlobs(sess *session) string    { return manifestPath("base-" + sess.ID + ".blobs") }
+
+func readManifest(name string) (workdir.Manifest, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var m workdir.Manifest
+	return m, json.Unmarshal(b, &m)
+}
+
+func writeManifest(name string, m workdir.Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0644)
+}
+
+// scanBase records the workdir as the session starts, unless a reexec already did.
+// Only the uncommitted changes are archived: the files git has are archived from
+// it when a snapshot first sees them changed, and the ignored ones are not kept.
+func scanBase(sess *session) error {
+	if fileExists(baseManifest(sess)) {
+		return nil
+	}
+	if err := os.MkdirAll(workdirsDir, 0755); err != nil {
+		return err
+	}
+	m, err := workdir.Scan(sess.Workdir)
+	if err != nil {
+		return err
+	}
+	blobs, uncommitted := gitSources(sess.Workdir, m)
+	f, err := os.Create(baseArchive(sess))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := workdir.WriteArchive(f, sess.Workdir, uncommitted); err != nil {
+		return err
+	}
+	b, err := json.Marshal(blobs)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(baseBlobs(sess), b, 0644); err != nil {
+		return err
+	}
+	return writeManifest(baseManifest(sess), m)
+}
+
+// gitSources returns the git blobs of the files of m that are committed or
+// staged as they are, and the sorted paths of the others git doesn't ignore.
+// Outside of a repository, it has neither.
+func gitSources(dir string, m workdir.Manifest) (blobs map[string]string, uncommitted []string) {
+	lines := func(args ...string) ([]string, error) {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+		if err != nil || len(out) == 0 {
+			return nil, err
+		}
+		return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00"), nil
+	}
+	staged, err := lines("ls-files", "--stage", "-z")
+	if err != nil {
+		return nil, nil
+	}
+	// A file whose modification time changed shows as modified, it is archived to be safe.
+	modified, _ := lines("diff-files", "--name-only", "--relative", "-z")
+	untracked, _ := lines("ls-files", "--others", "--exclude-standard", "-z")
+	blobs = map[string]string{}
+	for _, l := range staged {
+		// <mode> <blob> <stage>\t<path>
+		info, p, _ := strings.Cut(l, "\t")
+		if f := strings.Fields(info); len(f) == 3 && f[2] == "0" && f[0] != "160000" {
+			blobs[p] = f[1]
+		}
+	}
+	for _, p := range append(modified, untracked...) {
+		delete(blobs, p)
+		if _, ok := m[p]; ok {
+			uncommitted = append(uncommitted, p)
+		}
+	}
+	maps.DeleteFunc(blobs, func(p, _ string) bool {
+		_, ok := m[p]
+		return !ok
+	})
+	slices.Sort(uncommitted)
+	return blobs, uncommitted
+}
+
+// archiveBase archives what the files of paths held when the session started
+// from git, for those a snapshot sees changed for the first time.
+func archiveBase(sess *session, id string, base workdir.Manifest, paths []string) error {
+	b, err := os.ReadFile(baseBlobs(sess))
+	if err != nil {
+		return err
+	}
+	var blobs map[string]string
+	if err := json.Unmarshal(b, &blobs); err != nil {
+		return err
+	}
+	var first []string
+	for _, p := range paths {
+		if _, ok := blobs[p]; ok {
+			first = append(first, p)
+		}
+	}
+	if len(first) == 0 {
+		return nil
+	}
+	f, err := os.Create(archivePath("base-" + sess.ID + "-" + id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = workdir.WriteArchiveFrom(f, base, first, func(p string) ([]byte, error) {
+		// With the filters checking it out would apply.
+		return exec.Command("git", "-C", sess.Workdir, "cat-file", "--filters", "--path="+p, blobs[p]).Output()
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range first {
+		delete(blobs, p)
+	}
+	if b, err = json.Marshal(blobs); err != nil {
+		return err
+	}
+	return os.WriteFile(baseBlobs(sess), b, 0644)
+}
+
+// archiveWorkdir archives the files changed since the session's head for the snapshot id.
+func archiveWorkdir(sess *session, id string) error {
+	prev := baseManifest(sess)
+	if sess.Head != "" && fileExists(manifestPath(sess.Head)) {
+		prev = manifestPath(sess.Head)
+	}
+	old, err := readManifest(prev)
+	if err != nil {
+		return err
+	}
+	cur, err := workdir.Scan(sess.Workdir)
+	if err != nil {
+		return err
+	}
+	changed := workdir.Changed(old, cur)
+	base, err := readManifest(baseManifest(sess))
+	if err != nil {
+		return err
+	}
+	// Removed files need their content back too.
+	touched := slices.Clone(changed)
+	for p := range old {
+		if _, ok := cur[p]; !ok {
+			touched = append(touched, p)
+		}
+	}
+	if err := archiveBase(sess, id, base, touched); err != nil {
+		return fmt.Errorf("archiving the start of the workdir: %w", err)
+	}
+	f, err := os.Create(archivePath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := workdir.WriteArchive(f, sess.Workdir, changed); err != nil {
+		return err
+	}
+	fmt.Fprintln(logFile, "Archived", len(changed), "changed workdir files")
+	return writeManifest(manifestPath(id), cur)
+}
+
+// restoreWorkdir brings the host workdir back to target, or to the start of the
+// session if target is nil. Only the files the snapshots of the session saw
+// created are removed, the others are kept and reported.
+func restoreWorkdir(sess *session, tree *snapshot.Tree, target *snapshot.Snapshot) error {
+	base, err := readManifest(baseManifest(sess))
+	if err != nil {
+		return err
+	}
+	m := base
+	var archives []string
+	if target != nil {
+		if m, err = readManifest(manifestPath(target.ID)); err != nil {
+			return err
+		}
+		chain := tree.Ancestors(target.ID)
+		slices.Reverse(chain)
+		for _, s := range chain {
+			if s.WorkdirArchive {
+				archives = append(archives, archivePath(s.ID))
+			}
+		}
+	}
+	created := workdir.Manifest{}
+	_, snaps, _ := tree.Session(sess.ID)
+	for _, s := range snaps {
+		if sm, err := readManifest(manifestPath(s.ID)); err == nil {
+			maps.Copy(created, sm)
+		}
+	}
+	lazy, err := filepath.Glob(archivePath("base-" + sess.ID + "-*"))
+	if err != nil {
+		return err
+	}
+	kept, differ, err := workdir.Restore(sess.Workdir, base, append([]string{baseArchive(sess)}, lazy...), archives, m, created)
+	if err != nil {
+		return err
+	}
+	if len(kept) > 0 {
+		fmt.Fprintln(logFile, "Kept workdir files no snapshot saw the agent create:", kept)
+		fmt.Fprintf(os.Stderr, "cosmos: kept %d files of the workdir the agent didn't create, see %s\n", len(kept), filepath.Join(sessionDir(sess.ID), "cosmos.log"))
+	}
+	if len(differ) > 0 {
+		fmt.Fprintln(logFile, "Workdir files that could not be restored:", differ)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tiborvass/cosmos/policy"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// opts are the cosmos options, given before the coding agent or command.
+var opts struct {
+	// Snapshot is "turn" to snapshot at the end of each turn that ran tools,
+	// or "tool" to snapshot after each tool call that changed the container filesystem.
+	Snapshot string
+	// SnapshotBackend is "docker" to snapshot the whole container, "git" to commit
+	// the workdir in its repository on the host, or "store" to record it in the
+	// content-addressed store.
+	SnapshotBackend string
+	// SquashLayers is the number of layers from which docker snapshot images are
+	// squashed into one, 0 to never squash them.
+	SquashLayers int
+	// Verify is a shell command run in the workdir of the container after the
+	// snapshot of each turn, whose result is recorded in the snapshot.
+	Verify string
+	// Policy is the policy file deciding what happens to the tool calls of the agent,
+	// policy.json in the cosmos directory if it exists.
+	Policy string
+	// Network is "full" to let the agent reach anything, "allowlist" to only let it
+	// reach the Allow domains and their subdomains, or "none" to only let it reach the API.
+	Network string
+	Allow   []string
+	// Deny are domains the agent can't reach through the proxy, whatever the network mode.
+	Deny []string
+	// MITM are domains whose HTTPS traffic the proxy decrypts and logs, with a CA trusted in the container.
+	MITM []string
+	// Mount is how the workdir gets into the container: "copy", "bind" or "overlay".
+	Mount string
+	// Sandbox limits the resources and privileges of the container.
+	Sandbox sandbox
+}
+
+// parseOptions parses the cosmos options in args and returns the remaining arguments.
+func parseOptions(args []string) []string {
+	fs := flag.NewFlagSet("cosmos", flag.ExitOnError)
+	fs.Usage = usage
+	fs.StringVar(&opts.Snapshot, "snapshot", "turn", "when to snapshot: \"turn\" or \"tool\"")
+	fs.StringVar(&opts.SnapshotBackend, "snapshot-backend", backendDocker, "what snapshots record: \"docker\", \"git\" or \"store\"")
+	fs.StringVar(&opts.Verify, "verify", "", "shell command run in the workdir after the snapshot of each turn")
+	fs.IntVar(&opts.SquashLayers, "squash-layers", 100, "layers from which snapshot images are squashed, 0 for never")
+	fs.StringVar(&opts.Policy, "policy", "", "tool call policy file")
+	fs.StringVar(&opts.Network, "network", "full", "what the agent can reach: \"full\", \"allowlist\" or \"none\"")
+	fs.Func("allow", "domain reachable with --network=allowlist, can be repeated", listFlag(&opts.Allow))
+	fs.Func("deny", "domain never reachable, can be repeated", listFlag(&opts.Deny))
+	fs.Func("mitm", "domain whose HTTPS requests are decrypted and logged, can be repeated", listFlag(&opts.MITM))
+	fs.StringVar(&opts.Mount, "mount-mode", mountCopy, "how the workdir gets into the container: \"copy\", \"bind\" or \"overlay\"")
+	fs.StringVar(&opts.Sandbox.CPUs, "cpus", "", "CPUs the container can use, e.g. 2 or 1.5")
+	fs.StringVar(&opts.Sandbox.Memory, "memory", "", "memory the container can use, e.g. 4g")
+	fs.IntVar(&opts.Sandbox.PidsLimit, "pids-limit", 0, "processes the container can run, 0 for no limit")
+	fs.BoolVar(&opts.Sandbox.ReadOnly, "read-only", false, "read-only root filesystem, which disables docker snapshots")
+	fs.Func("cap-drop", "capability to drop, ALL for all but those cosmos needs, can be repeated", listFlag(&opts.Sandbox.CapDrop))
+	fs.StringVar(&opts.Sandbox.Seccomp, "seccomp", "", "seccomp profile file")
+	fs.BoolVar(&opts.Sandbox.NoNewPrivileges, "no-new-privileges", false, "keep the processes of the container from gaining privileges")
+	fs.Parse(args)
+
+	switch opts.Snapshot {
+	case "turn", "tool":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --snapshot %q\n", opts.Snapshot)
+		usage()
+		os.Exit(1)
+	}
+
+	switch opts.Network {
+	case "full", "allowlist", "none":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --network %q\n", opts.Network)
+		usage()
+		os.Exit(1)
+	}
+	if len(opts.Allow) > 0 && opts.Network != "allowlist" {
+		fmt.Fprintln(os.Stderr, "--allow needs --network=allowlist")
+		os.Exit(1)
+	}
+
+	switch opts.SnapshotBackend {
+	case backendDocker, backendGit, backendStore:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --snapshot-backend %q\n", opts.SnapshotBackend)
+		usage()
+		os.Exit(1)
+	}
+	switch opts.Mount {
+	case mountCopy, mountBind, mountOverlay:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --mount-mode %q\n", opts.Mount)
+		usage()
+		os.Exit(1)
+	}
+	if opts.SnapshotBackend == backendGit && opts.Mount == mountOverlay {
+		fmt.Fprintln(os.Stderr, "--snapshot-backend=git restores the workdir in the container, it can't be used with --mount-mode=overlay")
+		os.Exit(1)
+	}
+	if opts.SnapshotBackend == backendStore && opts.Mount != mountCopy {
+		fmt.Fprintln(os.Stderr, "--snapshot-backend=store records the workdir of the container, it needs --mount-mode=copy")
+		os.Exit(1)
+	}
+	if opts.Sandbox.ReadOnly && opts.Mount == mountOverlay {
+		fmt.Fprintln(os.Stderr, "--mount-mode=overlay needs a writable layer, it can't be used with --read-only")
+		os.Exit(1)
+	}
+	if opts.Sandbox.ReadOnly && len(opts.MITM) > 0 {
+		fmt.Fprintln(os.Stderr, "--mitm needs a writable trust store, it can't be used with --read-only")
+		os.Exit(1)
+	}
+	if opts.Sandbox.Seccomp != "" {
+		if !fileExists(opts.Sandbox.Seccomp) {
+			fmt.Fprintln(os.Stderr, "invalid --seccomp: no such file", opts.Sandbox.Seccomp)
+			os.Exit(1)
+		}
+		opts.Sandbox.Seccomp = M2(filepath.Abs(opts.Sandbox.Seccomp))
+	}
+
+	if opts.Policy == "" {
+		if name := filepath.Join(cosmosDir, "policy.json"); fileExists(name) {
+			opts.Policy = name
+		}
+	}
+	if opts.Policy != "" {
+		// Check the policy before the container starts, the proxy refuses to run with an invalid one.
+		if _, err := policy.Load(opts.Policy); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid --policy:", err)
+			os.Exit(1)
+		}
+		opts.Policy = M2(filepath.Abs(opts.Policy))
+	}
+	return fs.Args()
+}
+
+// listFlag appends the comma-separated values of a flag to list.
+func listFlag(list *[]string) func(string) error {
+	return func(s string) error {
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*list = append(*list, v)
+			}
+		}
+		return nil
+	}
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,245 @@
+// Package policy decides what happens to the tool calls of the agent.
+//
+// A policy is a list of rules read from a JSON file. Each tool call is checked
+// against the rules in order and the first one matching decides: let the call
+// through, refuse it, snapshot before it runs, or ask the user.
+//
+//	{
+//		"default": "allow",
+//		"rules": [
+//			{"tools": ["Bash"], "command": "\\brm\\s+-[a-z]*r", "action": "ask", "reason": "recursive delete"},
+//			{"tools": ["Edit", "Write", "MultiEdit"], "paths": ["**/.env*"], "action": "deny"},
+//			{"network": true, "action": "snapshot"}
+//		]
+//	}
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type Action string
+
+const (
+	Allow    Action = "allow"
+	Deny     Action = "deny"
+	Snapshot Action = "snapshot" // snapshot, then allow
+	Ask      Action = "ask"
+)
+
+func (a Action) valid() bool {
+	switch a {
+	case Allow, Deny, Snapshot, Ask:
+		return true
+	}
+	return false
+}
+
+// Rule matches the tool calls meeting all of its conditions.
+type Rule struct {
+	// Tools are globs on the tool name, any tool if empty.
+	Tools []string `json:"tools,omitempty"`
+	// Command is a regular expression matched against the command of shell tools.
+	Command string `json:"command,omitempty"`
+	// Paths are globs on the file the tool works on, where ** matches any number of directories.
+	Paths []string `json:"paths,omitempty"`
+	// Network matches the tools and commands reaching out to the network.
+	Network bool `json:"network,omitempty"`
+
+	Action Action `json:"action"`
+	Reason string `json:"reason,omitempty"`
+
+	command *regexp.Regexp
+	paths   []*regexp.Regexp
+}
+
+type Policy struct {
+	Default Action  `json:"default,omitempty"` // allow if empty
+	Rules   []*Rule `json:"rules"`
+}
+
+// Decision is the outcome of checking a tool call.
+type Decision struct {
+	Action Action
+	Reason string
+	Rule   int // index of the matching rule, -1 for the default
+}
+
+// Load reads the policy file at name.
+func Load(name string) (*Policy, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return p, nil
+}
+
+// Parse parses and validates a JSON policy.
+func Parse(b []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	if p.Default == "" {
+		p.Default = Allow
+	}
+	if !p.Default.valid() {
+		return nil, fmt.Errorf("invalid default action %q", p.Default)
+	}
+	for i, r := range p.Rules {
+		if !r.Action.valid() {
+			return nil, fmt.Errorf("rule %d: invalid action %q", i, r.Action)
+		}
+		for _, t := range r.Tools {
+			if _, err := path.Match(t, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: tool %q: %w", i, t, err)
+			}
+		}
+		if r.Command != "" {
+			re, err := regexp.Compile(r.Command)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: command: %w", i, err)
+			}
+			r.command = re
+		}
+		for _, g := range r.Paths {
+			r.paths = append(r.paths, globRegexp(g))
+		}
+	}
+	return p, nil
+}
+
+// Evaluate decides what to do with the call of tool with the JSON input.
+func (p *Policy) Evaluate(tool string, input json.RawMessage) Decision {
+	var fields map[string]any
+	json.Unmarshal(input, &fields)
+	call := call{tool: tool}
+	call.command, _ = fields["command"].(string)
+	for _, k := range []string{"file_path", "notebook_path", "path"} {
+		if s, ok := fields[k].(string); ok && s != "" {
+			call.path = s
+			break
+		}
+	}
+	for i, r := range p.Rules {
+		if r.matches(call) {
+			return Decision{Action: r.Action, Reason: r.Reason, Rule: i}
+		}
+	}
+	return Decision{Action: p.Default, Rule: -1}
+}
+
+type call struct {
+	tool    string
+	command string
+	path    string
+}
+
+func (r *Rule) matches(c call) bool {
+	if len(r.Tools) > 0 && !anyMatch(r.Tools, c.tool) {
+		return false
+	}
+	if r.command != nil && (c.command == "" || !r.command.MatchString(c.command)) {
+		return false
+	}
+	if len(r.paths) > 0 {
+		if c.path == "" {
+			return false
+		}
+		matched := false
+		for _, re := range r.paths {
+			if re.MatchString(c.path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.Network && !usesNetwork(c) {
+		return false
+	}
+	return true
+}
+
+func anyMatch(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// networkTools reach out to the network by themselves.
+var networkTools = []string{"WebFetch", "WebSearch", "mcp__*"}
+
+// networkCommand matches the shell commands that commonly reach out to the network.
+var networkCommand = regexp.MustCompile(`(^|[\s;&|(])(curl|wget|nc|ncat|telnet|ssh|scp|sftp|rsync|ftp)\b` +
+	`|\bgit\s+(clone|fetch|pull|push|ls-remote|submodule)\b` +
+	`|\b(npm|pnpm|yarn|bun)\s+(install|i|add|publish|update|upgrade)\b|\bnpx\b` +
+	`|\bpip3?\s+(install|download)\b|\buv\s+(pip|add|sync)\b` +
+	`|\bgo\s+(get|install|mod\s+download)\b|\bcargo\s+(install|fetch|publish)\b` +
+	`|\b(apt|apt-get|apk|yum|dnf|brew)\s+(install|update|upgrade|add)\b` +
+	`|\bdocker\s+(pull|push|login)\b`)
+
+func usesNetwork(c call) bool {
+	return anyMatch(networkTools, c.tool) || networkCommand.MatchString(c.command)
+}
+
+// globRegexp compiles a path glob: * and ? don't match /, ** matches anything.
+// A glob without / matches the base name of the path.
+func globRegexp(g string) *regexp.Regexp {
+	var sb strings.Builder
+	if !strings.Contains(g, "/") {
+		sb.WriteString(`(^|/)`)
+	} else {
+		sb.WriteString(`^`)
+	}
+	for i := 0; i < len(g); i++ {
+		switch c := g[i]; c {
+		case '*':
+			if i+1 < len(g) && g[i+1] == '*' {
+				i++
+				if i+1 < len(g) && g[i+1] == '/' {
+					// **/ also matches no directory at all
+					i++
+					sb.WriteString(`(.*/)?`)
+				} else {
+					sb.WriteString(`.*`)
+				}
+			} else {
+				sb.WriteString(`[^/]*`)
+			}
+		case '?':
+			sb.WriteString(`[^/]`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString(`$`)
+	return regexp.MustCompile(sb.String())
+}
+
+// ApprovalRequest asks the user whether a tool call matching an ask rule may run.
+type ApprovalRequest struct {
+	Tool   string
+	Input  json.RawMessage
+	Reason string
+}
+
+// Approval is the answer to an ApprovalRequest.
+type Approval struct {
+	Allow  bool
+	Reason string // why the call was refused, shown to the agent
+}
@@ -0,0 +1,60 @@
+package policy
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testPolicy = `{
+	"default": "allow",
+	"rules": [
+		{"tools": ["Bash"], "command": "\\brm\\s+-[a-z]*r", "action": "ask", "reason": "recursive delete"},
+		{"tools": ["Edit", "Write"], "paths": ["**/.env*", "/etc/**"], "action": "deny", "reason": "secrets"},
+		{"tools": ["Write"], "paths": ["*.lock"], "action": "snapshot"},
+		{"network": true, "action": "deny", "reason": "offline"}
+	]
+}`
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tool, input string
+		want        Action
+		rule        int
+	}{
+		{"Bash", `{"command":"rm -rf build"}`, Ask, 0},
+		{"Bash", `{"command":"ls -r"}`, Allow, -1},
+		{"Edit", `{"file_path":"/w/.env.local"}`, Deny, 1},
+		{"Edit", `{"file_path":".env"}`, Deny, 1},
+		{"Write", `{"file_path":"/etc/passwd"}`, Deny, 1},
+		{"Read", `{"file_path":"/etc/passwd"}`, Allow, -1},
+		{"Write", `{"file_path":"/w/go.lock"}`, Snapshot, 2},
+		{"Write", `{"file_path":"/w/lock/x"}`, Allow, -1},
+		{"Bash", `{"command":"cd x && curl https://example.com"}`, Deny, 3},
+		{"Bash", `{"command":"git push origin main"}`, Deny, 3},
+		{"Bash", `{"command":"git status"}`, Allow, -1},
+		{"Bash", `{"command":"go test ./..."}`, Allow, -1},
+		{"WebFetch", `{"url":"https://example.com"}`, Deny, 3},
+	} {
+		d := p.Evaluate(tc.tool, json.RawMessage(tc.input))
+		if d.Action != tc.want || d.Rule != tc.rule {
+			t.Errorf("%s %s: got %s (rule %d), want %s (rule %d)", tc.tool, tc.input, d.Action, d.Rule, tc.want, tc.rule)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"action": "block"}]}`,
+		`{"rules": [{"command": "(", "action": "deny"}]}`,
+		`{"rules": [{"tools": ["["], "action": "deny"}]}`,
+	} {
+		if _, err := Parse([]byte(s)); err == nil {
+			t.Errorf("Parse(%s) succeeded", s)
+		}
+	}
+}
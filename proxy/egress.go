@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Network modes of the container.
+const (
+	networkFull      = "full"      // the agent reaches anything
+	networkAllowlist = "allowlist" // the agent reaches the allowed domains through the proxy
+	networkNone      = "none"      // the agent reaches nothing but the proxy
+)
+
+// egress controls what the agent can reach besides the API.
+type egress struct {
+	mode  string
+	allow []string // domains reachable in allowlist mode, with their subdomains
+	deny  []string // domains never reachable through the proxy, with their subdomains
+}
+
+func egressFromEnv() *egress {
+	e := &egress{
+		mode:  os.Getenv("COSMOS_NETWORK"),
+		allow: domainList(os.Getenv("COSMOS_ALLOW")),
+		deny:  domainList(os.Getenv("COSMOS_DENY")),
+	}
+	if e.mode == "" {
+		e.mode = networkFull
+	}
+	return e
+}
+
+func domainList(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, strings.ToLower(d))
+		}
+	}
+	return domains
+}
+
+// restricted reports whether the agent's traffic has to go through the proxy.
+func (e *egress) restricted() bool {
+	return e.mode != networkFull
+}
+
+// allowed reports whether the agent may connect to host. Denied domains win over allowed ones.
+func (e *egress) allowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchDomain(e.deny, host) {
+		return false
+	}
+	switch e.mode {
+	case networkFull:
+		return true
+	case networkAllowlist:
+		return matchDomain(e.allow, host)
+	}
+	return false
+}
+
+// matchDomain reports whether host is one of domains or a subdomain of one. "*" matches any host.
+func matchDomain(domains []string, host string) bool {
+	for _, d := range domains {
+		if d == "*" || host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// egressEvent is a connection attempt of the agent, reported to the manager
+// once the connection is over.
+type egressEvent struct {
+	Time     time.Time
+	Host     string
+	Port     string
+	Via      string // "proxy" for proxied requests, "mitm" for the requests decrypted from a tunnel, "direct" for connections bypassing the proxy
+	Allowed  bool
+	Method   string        `json:",omitempty"`
+	URL      string        `json:",omitempty"`
+	Status   int           `json:",omitempty"`
+	Sent     int64         `json:",omitempty"` // bytes from the agent
+	Received int64         `json:",omitempty"` // bytes to the agent
+	Duration time.Duration `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+func (p *Proxy) reportEgress(ctx context.Context, ev egressEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	logger.Printf("===EGRESS=== %s %s:%s %s %s %d allowed=%v sent=%d received=%d %v %s\n", ev.Via, ev.Host, ev.Port, ev.Method, ev.URL, ev.Status, ev.Allowed, ev.Sent, ev.Received, ev.Duration, ev.Error)
+	if err := p.manager.Send(ctx, "egress", ev); err != nil {
+		logger.Println("===EGRESS=== reporting:", err)
+	}
+}
+
+// egressKey is the context key of the egressEvent of a forwarded request.
+type egressKey struct{}
+
+// handleConnect tunnels a CONNECT request to the requested host if the network rules allow it.
+func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, "443"
+	}
+	ev := egressEvent{Time: time.Now(), Host: host, Port: port, Via: "proxy", Allowed: p.egress.allowed(host)}
+	defer func() {
+		ev.Duration = time.Since(ev.Time)
+		p.reportEgress(ctx, ev)
+	}()
+	if !ev.Allowed {
+		http.Error(w, "cosmos: "+host+" is not allowed by the network rules", http.StatusForbidden)
+		return
+	}
+
+	// Intercepted tunnels connect upstream for each request they carry.
+	intercept := p.mitm != nil && p.mitm.intercepts(host)
+	var upstream net.Conn
+	if !intercept {
+		upstream, err = (&net.Dialer{Timeout: 30 * time.Second}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			ev.Error = err.Error()
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+	}
+	logger.Printf("===EGRESS=== tunnel to %s:%s open, intercepted=%v\n", host, port, intercept)
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		ev.Error = "hijacking not supported"
+		http.Error(w, ev.Error, http.StatusInternalServerError)
+		return
+	}
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		ev.Error = err.Error()
+		return
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		ev.Error = err.Error()
+		return
+	}
+	if intercept {
+		ev.Sent, ev.Received = p.intercept(ctx, client, brw, host, port)
+		return
+	}
+
+	// The client may have sent data right after the request, still buffered.
+	ev.Sent, ev.Received = splice(client, brw, upstream)
+}
+
+// splice copies what the client sends, read from r, to upstream and back until
+// both are done, and returns how many bytes went each way.
+func splice(client net.Conn, r io.Reader, upstream net.Conn) (sent, received int64) {
+	done := make(chan struct{}, 2)
+	go func() {
+		sent, _ = io.Copy(upstream, r)
+		upstream.(*net.TCPConn).CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		received, _ = io.Copy(client, upstream)
+		if c, ok := client.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+	return sent, received
+}
+
+// forwardTransport carries the plain HTTP requests of the agent, the proxy itself
+// having no proxy.
+var forwardTransport = &http.Transport{
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+	ResponseHeaderTimeout: time.Minute,
+}
+
+// handleForward forwards a plain HTTP request sent to the proxy, in absolute
+// form, if the network rules allow its host.
+func (p *Proxy) handleForward(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	ev := egressEvent{Time: time.Now(), Host: r.URL.Hostname(), Port: port, Via: "proxy", Allowed: p.egress.allowed(r.URL.Hostname())}
+	body := &countingReader{ReadCloser: r.Body}
+	cw := &countingWriter{ResponseWriter: w}
+	defer func() {
+		ev.Sent, ev.Received, ev.Status = body.n, cw.n, cw.status
+		ev.Duration = time.Since(ev.Time)
+		p.reportEgress(ctx, ev)
+	}()
+	if !ev.Allowed {
+		http.Error(w, "cosmos: "+ev.Host+" is not allowed by the network rules", http.StatusForbidden)
+		return
+	}
+	r.Body = body
+	rp := &httputil.ReverseProxy{
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: forwardTransport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ev.Error = err.Error()
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	rp.ServeHTTP(cw, r)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.ReadCloser.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush the response.
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// mkdirAllAs creates dir like os.MkdirAll, giving the directories created under
+// root to u.
+func mkdirAllAs(dir, root string, u *user.User) error {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for d := dir; d != root && d != filepath.Dir(d); d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, d := range missing {
+		if err := os.Chown(d, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEgressAllowed(t *testing.T) {
+	e := &egress{mode: networkAllowlist, allow: []string{"github.com", "pypi.org"}}
+	for host, want := range map[string]bool{
+		"github.com":          true,
+		"api.github.com":      true,
+		"GitHub.com.":         true,
+		"notgithub.com":       false,
+		"github.com.evil.net": false,
+		"pypi.org":            true,
+		"example.com":         false,
+	} {
+		if got := e.allowed(host); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", host, got, want)
+		}
+	}
+	if (&egress{mode: networkNone, allow: []string{"*"}}).allowed("github.com") {
+		t.Error("network mode none allowed a host")
+	}
+	if !(&egress{mode: networkFull}).allowed("example.com") {
+		t.Error("network mode full refused a host")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		c, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	managerConn, hostConn := net.Pipe()
+	defer hostConn.Close()
+	events := make(chan egressEvent, 2)
+	go func() {
+		d := json.NewDecoder(hostConn)
+		for {
+			var msg struct{ Data egressEvent }
+			if d.Decode(&msg) != nil {
+				return
+			}
+			events <- msg.Data
+		}
+	}()
+	p := &Proxy{manager: newManagerClient(managerConn), egress: &egress{mode: networkFull, deny: []string{"example.com"}}}
+	srv := httptest.NewServer(http.HandlerFunc(p.handleConnect))
+	defer srv.Close()
+
+	connect := func(target string) (net.Conn, *http.Response) {
+		t.Helper()
+		c, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, resp
+	}
+
+	c, resp := connect("www.example.com:443")
+	c.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("denied host: got status %d", resp.StatusCode)
+	}
+	if ev := <-events; ev.Allowed || ev.Host != "www.example.com" {
+		t.Errorf("denied host: got event %+v", ev)
+	}
+
+	c, resp = connect(upstream.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed host: got status %d", resp.StatusCode)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+	if b, err := io.ReadAll(c); err != nil || string(b) != "ping" {
+		t.Errorf("tunnel echoed %q, %v", b, err)
+	}
+	c.Close()
+	if ev := <-events; !ev.Allowed || ev.Sent != 4 || ev.Received != 4 {
+		t.Errorf("allowed host: got event %+v", ev)
+	}
+}
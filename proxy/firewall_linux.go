@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// egressTrapPort receives the TCP connections of the agent that bypass the proxy.
+const egressTrapPort = "8043"
+
+// setupFirewall redirects the TCP connections of the agent running as uid to the
+// egress trap. Unless full is set, it also only lets root, which the proxy runs
+// as, reach the network.
+func setupFirewall(uid int, full bool) error {
+	u := strconv.Itoa(uid)
+	rules := [][]string{
+		{"iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "!", "-d", "127.0.0.0/8", "-m", "owner", "--uid-owner", u, "-j", "REDIRECT", "--to-ports", egressTrapPort},
+	}
+	if full {
+		// The trap forwards the connections, the rest goes through.
+		return runRules(rules)
+	}
+	rules = append(rules,
+		[]string{"iptables", "-A", "OUTPUT", "-o", "lo", "-j", "ACCEPT"},
+		[]string{"iptables", "-A", "OUTPUT", "-m", "owner", "--uid-owner", "0", "-j", "ACCEPT"},
+		[]string{"iptables", "-A", "OUTPUT", "-j", "REJECT"},
+	)
+	if err := runRules(rules); err != nil {
+		return err
+	}
+	for _, args := range [][]string{
+		{"ip6tables", "-A", "OUTPUT", "-o", "lo", "-j", "ACCEPT"},
+		{"ip6tables", "-A", "OUTPUT", "-m", "owner", "--uid-owner", "0", "-j", "ACCEPT"},
+		{"ip6tables", "-A", "OUTPUT", "-j", "REJECT"},
+	} {
+		// Without IPv6 in the container, there is nothing to block.
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			logger.Printf("===EGRESS=== %v: %v: %s\n", args, err, out)
+			break
+		}
+	}
+	return nil
+}
+
+func runRules(rules [][]string) error {
+	for _, args := range rules {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %w: %s", args, err, out)
+		}
+	}
+	return nil
+}
+
+// trapEgress accepts the connections redirected by the firewall and reports their
+// original destination. It forwards them there in the full network mode, and
+// closes them in the others.
+func (p *Proxy) trapEgress(ctx context.Context) error {
+	l, err := net.Listen("tcp", "127.0.0.1:"+egressTrapPort)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		ev := egressEvent{Time: time.Now(), Via: "direct"}
+		dst, err := originalDst(c.(*net.TCPConn))
+		if err != nil {
+			ev.Error = err.Error()
+		} else {
+			ev.Host, ev.Port, _ = net.SplitHostPort(dst)
+		}
+		if err != nil || p.egress.restricted() {
+			c.Close()
+			p.reportEgress(ctx, ev)
+			continue
+		}
+		go func() {
+			defer c.Close()
+			ev.Allowed = true
+			defer func() {
+				ev.Duration = time.Since(ev.Time)
+				p.reportEgress(ctx, ev)
+			}()
+			upstream, err := (&net.Dialer{Timeout: 30 * time.Second}).DialContext(ctx, "tcp", dst)
+			if err != nil {
+				ev.Error = err.Error()
+				return
+			}
+			defer upstream.Close()
+			ev.Sent, ev.Received = splice(c, c, upstream)
+		}()
+	}
+}
+
+// originalDst returns the destination of a connection before it was redirected.
+func originalDst(c *net.TCPConn) (string, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var addr *unix.IPv6Mreq
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		// SO_ORIGINAL_DST returns a sockaddr_in, which fits in an IPv6Mreq.
+		addr, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	}); err != nil {
+		return "", err
+	}
+	if serr != nil {
+		return "", serr
+	}
+	b := addr.Multiaddr
+	port := int(b[2])<<8 | int(b[3])
+	return net.JoinHostPort(net.IPv4(b[4], b[5], b[6], b[7]).String(), strconv.Itoa(port)), nil
+}
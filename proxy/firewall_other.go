@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var errNoFirewall = errors.New("restricting the network needs Linux")
+
+func setupFirewall(uid int, full bool) error {
+	return errNoFirewall
+}
+
+func (p *Proxy) trapEgress(ctx context.Context) error {
+	return errNoFirewall
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/tiborvass/cosmos/tracing"
+)
+
+// managerMessage is an instruction for the manager. The manager replies to the
+// messages with an ID.
+type managerMessage struct {
+	ID     uint64 `json:",omitempty"`
+	Action string
+	Data   any
+	Trace  map[string]string
+}
+
+type managerReply struct {
+	ID    uint64
+	Data  json.RawMessage
+	Error string
+}
+
+var errManagerGone = errors.New("manager connection closed")
+
+// managerClient sends instructions to the manager running on the host.
+type managerClient struct {
+	m       sync.Mutex
+	enc     *json.Encoder
+	nextID  uint64
+	waiting map[uint64]chan managerReply
+	closed  bool
+}
+
+func newManagerClient(conn net.Conn) *managerClient {
+	c := &managerClient{
+		enc:     json.NewEncoder(conn),
+		waiting: map[uint64]chan managerReply{},
+	}
+	go c.readReplies(conn)
+	return c
+}
+
+func (c *managerClient) readReplies(r io.Reader) {
+	d := json.NewDecoder(r)
+	for {
+		var reply managerReply
+		if err := d.Decode(&reply); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Println("===MANAGER=== reading replies:", err)
+			}
+			break
+		}
+		c.m.Lock()
+		ch, ok := c.waiting[reply.ID]
+		delete(c.waiting, reply.ID)
+		c.m.Unlock()
+		if ok {
+			ch <- reply
+		}
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.closed = true
+	for id, ch := range c.waiting {
+		ch <- managerReply{ID: id, Error: errManagerGone.Error()}
+		delete(c.waiting, id)
+	}
+}
+
+// Send sends an instruction without waiting for it to be carried out.
+func (c *managerClient) Send(ctx context.Context, action string, data any) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.enc.Encode(managerMessage{Action: action, Data: data, Trace: tracing.Inject(ctx)})
+}
+
+// Call sends an instruction and waits for the manager to reply, decoding the reply into reply.
+func (c *managerClient) Call(ctx context.Context, action string, data, reply any) error {
+	ch := make(chan managerReply, 1)
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return errManagerGone
+	}
+	c.nextID++
+	id := c.nextID
+	c.waiting[id] = ch
+	err := c.enc.Encode(managerMessage{ID: id, Action: action, Data: data, Trace: tracing.Inject(ctx)})
+	if err != nil {
+		delete(c.waiting, id)
+	}
+	c.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.m.Lock()
+		delete(c.waiting, id)
+		c.m.Unlock()
+		return ctx.Err()
+	case r := <-ch:
+		if r.Error != "" {
+			return errors.New(r.Error)
+		}
+		if reply == nil || len(r.Data) == 0 {
+			return nil
+		}
+		return json.Unmarshal(r.Data, reply)
+	}
+}
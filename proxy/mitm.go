@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mitmCAFile is where the CA is installed in the container, picked up by update-ca-certificates.
+	mitmCAFile = "/usr/local/share/ca-certificates/cosmos.crt"
+	// systemCAs is the trust store update-ca-certificates generates.
+	systemCAs = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// mitm decrypts the tunnels to the hosts it intercepts, presenting certificates
+// signed by a CA of its own. The CA lives as long as the proxy, its key is never
+// written down.
+type mitm struct {
+	hosts   []string // intercepted domains, with their subdomains
+	ca      *x509.Certificate
+	caKey   crypto.Signer
+	leafKey crypto.Signer // shared by the host certificates
+
+	m     sync.Mutex
+	certs map[string]*tls.Certificate // by host
+}
+
+func newMITM(hosts []string) (*mitm, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{CommonName: "cosmos session CA", Organization: []string{"cosmos"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(7 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &mitm{hosts: hosts, ca: ca, caKey: caKey, leafKey: leafKey, certs: map[string]*tls.Certificate{}}, nil
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+// intercepts reports whether the tunnels to host are decrypted.
+func (m *mitm) intercepts(host string) bool {
+	return matchDomain(m.hosts, host)
+}
+
+// installCA adds the CA to the container's trust store. A CA left by an earlier
+// session, in a snapshot, is replaced.
+func (m *mitm) installCA() error {
+	if err := os.WriteFile(mitmCAFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.ca.Raw}), 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("update-ca-certificates").CombinedOutput(); err != nil {
+		return fmt.Errorf("update-ca-certificates: %w: %s", err, out)
+	}
+	return nil
+}
+
+// certificate returns a certificate for host signed by the CA.
+func (m *mitm) certificate(host string) (*tls.Certificate, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if cert, ok := m.certs[host]; ok {
+		return cert, nil
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     m.ca.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.ca, m.leafKey.Public(), m.caKey)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, m.ca.Raw}, PrivateKey: m.leafKey}
+	m.certs[host] = cert
+	return cert, nil
+}
+
+// intercept serves the HTTPS requests the agent sends through the tunnel to
+// host:port, forwarding them upstream and reporting each one. It returns once the
+// agent closed the tunnel, with the bytes sent and received through it.
+func (p *Proxy) intercept(ctx context.Context, client net.Conn, r io.Reader, host, port string) (sent, received int64) {
+	cc := &countingConn{Conn: client, r: r}
+	conn := tls.Server(cc, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return p.mitm.certificate(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	upstream := host
+	if port != "443" {
+		upstream = net.JoinHostPort(host, port)
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = upstream
+		},
+		Transport: forwardTransport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if ev, ok := r.Context().Value(egressKey{}).(*egressEvent); ok {
+				ev.Error = err.Error()
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+	l := newConnListener(conn)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ev := egressEvent{Time: time.Now(), Host: host, Port: port, Via: "mitm", Allowed: true, Method: r.Method, URL: "https://" + upstream + r.URL.RequestURI()}
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			cw := &countingWriter{ResponseWriter: w}
+			rp.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), egressKey{}, &ev)))
+			ev.Sent, ev.Received, ev.Status = body.n, cw.n, cw.status
+			ev.Duration = time.Since(ev.Time)
+			p.reportEgress(ctx, ev)
+		}),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+		ErrorLog: logger,
+	}
+	srv.Serve(l)
+	return cc.sent.Load(), cc.received.Load()
+}
+
+// countingConn counts the bytes read from r, standing for the connection's reads,
+// and written to the connection.
+type countingConn struct {
+	net.Conn
+	r              io.Reader
+	sent, received atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.sent.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.received.Add(int64(n))
+	return n, err
+}
+
+// connListener accepts a single connection, then blocks until closed.
+type connListener struct {
+	conn   chan net.Conn
+	addr   net.Addr
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(c net.Conn) *connListener {
+	l := &connListener{conn: make(chan net.Conn, 1), addr: c.LocalAddr(), closed: make(chan struct{})}
+	l.conn <- c
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conn:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
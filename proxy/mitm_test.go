@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIntercept(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.URL.Path)
+	}))
+	defer upstream.Close()
+	defer func(tr *http.Transport) { forwardTransport = tr }(forwardTransport)
+	forwardTransport = upstream.Client().Transport.(*http.Transport)
+
+	managerConn, hostConn := net.Pipe()
+	defer hostConn.Close()
+	events := make(chan egressEvent, 4)
+	go func() {
+		d := json.NewDecoder(hostConn)
+		for {
+			var msg struct{ Data egressEvent }
+			if d.Decode(&msg) != nil {
+				return
+			}
+			events <- msg.Data
+		}
+	}()
+	m, err := newMITM([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{manager: newManagerClient(managerConn), egress: &egress{mode: networkFull}, mitm: m}
+	srv := httptest.NewServer(http.HandlerFunc(p.handleConnect))
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(m.ca)
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: srv.Listener.Addr().String()}),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	resp, err := (&http.Client{Transport: tr}).Get(upstream.URL + "/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "hello from /x" {
+		t.Errorf("got %q", b)
+	}
+	if resp.TLS.PeerCertificates[0].Issuer.CommonName != m.ca.Subject.CommonName {
+		t.Errorf("response not intercepted, certificate issued by %s", resp.TLS.PeerCertificates[0].Issuer)
+	}
+	tr.CloseIdleConnections()
+
+	if ev := <-events; ev.Via != "mitm" || ev.Method != "GET" || ev.URL != upstream.URL+"/x" || ev.Status != 200 || ev.Received == 0 {
+		t.Errorf("got request event %+v", ev)
+	}
+	if ev := <-events; ev.Via != "proxy" || !ev.Allowed || ev.Sent == 0 || ev.Received == 0 {
+		t.Errorf("got tunnel event %+v", ev)
+	}
+}
+
+func TestInterceptFromEnv(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	defer func(tr *http.Transport) { forwardTransport = tr }(forwardTransport)
+	forwardTransport = upstream.Client().Transport.(*http.Transport)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	managerConn, hostConn := net.Pipe()
+	defer hostConn.Close()
+	go io.Copy(io.Discard, hostConn)
+	t.Setenv("COSMOS_MITM", "127.0.0.1")
+	p := startProxy(addr, managerConn, func() {})
+	defer p.Close()
+	if p.mitm == nil {
+		t.Fatal("COSMOS_MITM set, but no interception")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.mitm.ca)
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "http", Host: addr}),
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	defer tr.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: tr}).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.TLS.PeerCertificates[0].Issuer.CommonName != p.mitm.ca.Subject.CommonName {
+		t.Errorf("CONNECT to a listed host not intercepted, certificate issued by %s", resp.TLS.PeerCertificates[0].Issuer)
+	}
+}
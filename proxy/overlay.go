@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const (
+	// overlayLower is where the host mounts its workdir read-only in overlay mode.
+	overlayLower = "/mnt/cosmos-lower"
+	// overlayDir holds the writable layer, in the container filesystem so that snapshots commit it.
+	overlayDir = "/var/lib/cosmos/overlay"
+)
+
+// mountOverlay mounts the host workdir on dir under a writable layer. The layer
+// of a snapshot is already there and picks up where it left off. Files are owned by
+// uid and gid, whatever their owner on the host.
+func mountOverlay(dir string, uid, gid int) error {
+	upper, work := overlayDir+"/upper", overlayDir+"/work"
+	for _, d := range []string{upper, work, dir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s,squash_to_uid=%d,squash_to_gid=%d,allow_other", overlayLower, upper, work, uid, gid)
+	if out, err := exec.Command("fuse-overlayfs", "-o", opts, dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("fuse-overlayfs: %w: %s", err, out)
+	}
+	return nil
+}
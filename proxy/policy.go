@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tiborvass/cosmos/policy"
+	"github.com/tiborvass/cosmos/snapshot"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// filterTools returns the event stream of body with every tool_use block checked
+// against the policy. A block is held back until it is complete, then let through,
+// refused, or let through once a snapshot is taken or the user approved it.
+func (p *Proxy) filterTools(ctx context.Context, body io.ReadCloser, ex *exchange) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		f := &toolFilter{p: p, ex: ex, w: pw, held: map[int]*heldBlock{}}
+		pw.CloseWithError(f.run(ctx, body))
+	}()
+	return pr
+}
+
+type toolFilter struct {
+	p  *Proxy
+	ex *exchange
+	w  io.Writer
+
+	held            map[int]*heldBlock // by content block index
+	allowed, denied int                // tool_use blocks of the current message
+}
+
+type heldBlock struct {
+	id, name string
+	events   [][]byte
+	input    bytes.Buffer
+}
+
+func (f *toolFilter) run(ctx context.Context, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var ev []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		ev = append(ev, line...)
+		if len(bytes.TrimRight(line, "\r\n")) == 0 && len(ev) > 0 {
+			if err := f.handle(ctx, ev); err != nil {
+				return err
+			}
+			ev = nil
+		}
+		if err == io.EOF {
+			if len(ev) > 0 {
+				_, err := f.w.Write(ev)
+				return err
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+type streamEvent struct {
+	Type         string
+	Index        int
+	ContentBlock struct {
+		Type string
+		ID   string
+		Name string
+	} `json:"content_block"`
+	Delta struct {
+		Type        string
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	}
+}
+
+// eventData returns the concatenated data lines of a raw event.
+func eventData(ev []byte) []byte {
+	var data []byte
+	for _, line := range bytes.FieldsFunc(ev, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		if bytes.HasPrefix(line, headerData) {
+			data = append(data, trimHeader(len(headerData), line)...)
+		}
+	}
+	return data
+}
+
+func (f *toolFilter) handle(ctx context.Context, ev []byte) error {
+	data := eventData(ev)
+	var e streamEvent
+	if len(data) == 0 || json.Unmarshal(data, &e) != nil {
+		_, err := f.w.Write(ev)
+		return err
+	}
+	switch e.Type {
+	case "message_start":
+		f.allowed, f.denied = 0, 0
+	case "content_block_start":
+		if e.ContentBlock.Type == "tool_use" {
+			f.held[e.Index] = &heldBlock{id: e.ContentBlock.ID, name: e.ContentBlock.Name, events: [][]byte{ev}}
+			return nil
+		}
+	case "content_block_delta":
+		if b, ok := f.held[e.Index]; ok {
+			b.events = append(b.events, ev)
+			if e.Delta.Type == "input_json_delta" {
+				b.input.WriteString(e.Delta.PartialJSON)
+			}
+			return nil
+		}
+	case "content_block_stop":
+		if b, ok := f.held[e.Index]; ok {
+			delete(f.held, e.Index)
+			b.events = append(b.events, ev)
+			return f.decide(ctx, e.Index, b)
+		}
+	case "message_delta":
+		// With all its tools refused, the message ends the turn instead of waiting for tool results.
+		if f.denied > 0 && f.allowed == 0 && e.Delta.StopReason == "tool_use" {
+			var m map[string]any
+			if err := json.Unmarshal(data, &m); err == nil {
+				if delta, ok := m["delta"].(map[string]any); ok {
+					delta["stop_reason"] = "end_turn"
+					return writeEvent(f.w, "message_delta", m)
+				}
+			}
+		}
+	}
+	_, err := f.w.Write(ev)
+	return err
+}
+
+func (f *toolFilter) decide(ctx context.Context, index int, b *heldBlock) error {
+	input := json.RawMessage(b.input.Bytes())
+	if len(input) == 0 {
+		input = json.RawMessage("{}")
+	}
+	call := snapshot.NewToolCall(b.name, input)
+	d := f.p.policy.Evaluate(b.name, input)
+	logger.Printf("===POLICY=== %s: %s (rule %d)\n", call, d.Action, d.Rule)
+	trace.SpanFromContext(ctx).AddEvent("policy", trace.WithAttributes(
+		attribute.String("tool", b.name),
+		attribute.String("action", string(d.Action)),
+		attribute.Int("rule", d.Rule),
+	))
+
+	switch d.Action {
+	case policy.Deny:
+		return f.refuse(index, b, d.Reason)
+	case policy.Snapshot:
+		<-f.ex.done
+		if err := f.p.commitSync(ctx, "before "+call.String(), f.ex.chain.Head(), f.p.turn(f.ex.session, nil)); err != nil {
+			// The rule is there to be able to go back to before the call, don't run it without a snapshot.
+			logger.Println("===POLICY=== snapshot failed:", err)
+			return f.refuse(index, b, fmt.Sprintf("could not snapshot before running it: %v", err))
+		}
+	case policy.Ask:
+		var a policy.Approval
+		if err := f.p.manager.Call(ctx, "ask", policy.ApprovalRequest{Tool: b.name, Input: input, Reason: d.Reason}, &a); err != nil {
+			logger.Println("===POLICY=== approval failed:", err)
+			a = policy.Approval{Reason: fmt.Sprintf("could not ask for approval: %v", err)}
+		}
+		if !a.Allow {
+			return f.refuse(index, b, a.Reason)
+		}
+	}
+	f.allowed++
+	for _, ev := range b.events {
+		if _, err := f.w.Write(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refuse replaces the tool_use block with a text block telling the agent why it was refused.
+func (f *toolFilter) refuse(index int, b *heldBlock, reason string) error {
+	f.denied++
+	if reason == "" {
+		reason = "denied by policy"
+	}
+	text := fmt.Sprintf("[cosmos] The %s call was refused: %s.", b.name, reason)
+	return errors.Join(
+		writeEvent(f.w, "content_block_start", map[string]any{"type": "content_block_start", "index": index, "content_block": map[string]any{"type": "text", "text": ""}}),
+		writeEvent(f.w, "content_block_delta", map[string]any{"type": "content_block_delta", "index": index, "delta": map[string]any{"type": "text_delta", "text": text}}),
+		writeEvent(f.w, "content_block_stop", map[string]any{"type": "content_block_stop", "index": index}),
+	)
+}
+
+func writeEvent(w io.Writer, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
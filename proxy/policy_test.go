@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tiborvass/cosmos/policy"
+)
+
+func toolUseStream(command string) string {
+	return `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","role":"assistant","content":[]}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"Bash","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"command\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"` + command + `\"}"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":1}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+}
+
+func TestFilterTools(t *testing.T) {
+	pol, err := policy.Parse([]byte(`{"rules": [{"tools": ["Bash"], "command": "^rm ", "action": "deny", "reason": "no deleting"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{policy: pol}
+	ex := &exchange{done: make(chan struct{})}
+	close(ex.done)
+	filter := func(stream string) string {
+		t.Helper()
+		b, err := io.ReadAll(p.filterTools(context.Background(), io.NopCloser(strings.NewReader(stream)), ex))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	allowed := toolUseStream("ls")
+	if got := filter(allowed); got != allowed {
+		t.Errorf("allowed call was changed:\n%s", got)
+	}
+
+	got := filter(toolUseStream("rm x"))
+	for _, want := range []string{
+		`"content_block":{"text":"","type":"text"},"index":1`,
+		`The Bash call was refused: no deleting.`,
+		`"stop_reason":"end_turn"`,
+		`"type":"message_stop"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("refused call: missing %s in\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "tool_use") {
+		t.Errorf("refused call still has a tool_use:\n%s", got)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"compress/gzip"
 	"context"
 	"encoding/json"
@@ -16,6 +15,10 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -25,7 +28,17 @@ import (
 	"github.com/mattn/go-isatty"
 	"github.com/r3labs/sse"
 	"github.com/tiborvass/cosmos/ctxio"
+	"github.com/tiborvass/cosmos/history"
+	"github.com/tiborvass/cosmos/policy"
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/tracing"
+	"github.com/tiborvass/cosmos/transcript"
 	. "github.com/tiborvass/cosmos/utils"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sys/unix"
 )
 
@@ -36,42 +49,72 @@ const (
 var (
 	numRequests = 0
 	toolUseIDs  = map[string]struct{}{}
-	logger      *log.Logger
+	logger      = log.New(io.Discard, "", 0)
+	tracer      = otel.Tracer("github.com/tiborvass/cosmos/proxy")
 )
 
-func init() {
-	// Log to a file instead of stdout to avoid conflicts with Claude's TUI
-	logFile, err := os.OpenFile("/cosmos/proxy.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		panic(err)
-	} else {
-		logger = log.New(logFile, "\n[PROXY] ", log.LstdFlags)
-	}
-}
+// toolsTimeout bounds how long a snapshot waits for the tools of a turn to be logged as completed.
+const toolsTimeout = 5 * time.Second
 
 type Proxy struct {
 	http.Server
-	manager *json.Encoder
+	manager *managerClient
 	tt      *ToolsTracker
 	cancel  func()
-	// w       *fsnotify.Watcher
+
+	history *history.Tracker
+	// policy decides what happens to the tool calls, all are let through if nil.
+	policy *policy.Policy
+	// perTool snapshots after each tool call instead of at the end of the turn.
+	perTool bool
+	egress  *egress
+	// mitm decrypts the tunnels to some hosts, none if nil.
+	mitm *mitm
+
+	mTurns sync.Mutex
+	turns  map[string]*snapshot.Turn // turn in progress by session
 }
 
 func (p *Proxy) Close() {
-	// p.w.Close()
 }
 
+// waitTools waits until Claude has logged the result of every tool it was asked to run,
+// so that a snapshot never catches a tool halfway through its writes.
+func (p *Proxy) waitTools(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "proxy.wait_tools")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, toolsTimeout)
+	defer cancel()
+	if err := p.tt.Wait(ctx); err != nil {
+		pending := p.tt.GetPendingTools()
+		logger.Printf("===TOOLS=== gave up waiting for %d tools: %v\n", len(pending), err)
+		for id := range pending {
+			p.tt.markToolCompleted(id)
+		}
+	}
+}
+
+// set holds tool_use IDs and the description of the tool call.
 type set struct {
 	m sync.Mutex
-	s map[string]struct{}
+	s map[string]string
 }
 
-func (s *set) Add(key string) {
+func (s *set) Add(key, call string) {
 	s.m.Lock()
-	s.s[key] = struct{}{}
+	s.s[key] = call
 	s.m.Unlock()
 }
 
+// Take removes key and returns its tool call.
+func (s *set) Take(key string) (call string, ok bool) {
+	s.m.Lock()
+	call, ok = s.s[key]
+	delete(s.s, key)
+	s.m.Unlock()
+	return
+}
+
 func (s *set) Remove(key string) (n int) {
 	s.m.Lock()
 	delete(s.s, key)
@@ -80,13 +123,104 @@ func (s *set) Remove(key string) (n int) {
 	return
 }
 
+// exchange is the state of a request shared with the handling of its response.
+type exchange struct {
+	done    chan struct{} // closed once the request body was inspected
+	chain   history.Chain
+	session string
+	start   time.Time
+}
+
+var (
+	mExchanges  sync.Mutex
+	exchangeLog = json.NewEncoder(io.Discard)
+)
+
+// logExchange appends x to the exchange log, which lets cosmos transcript match
+// the agent's session logs with the API requests.
+func logExchange(resp *http.Response, x transcript.Exchange) {
+	x.RequestID = resp.Header.Get("request-id")
+	if x.RequestID == "" {
+		return
+	}
+	x.Time = time.Now()
+	x.Status = resp.StatusCode
+	if ex, ok := resp.Request.Context().Value(exchangeKey{}).(*exchange); ok && !ex.start.IsZero() {
+		x.Duration = x.Time.Sub(ex.start)
+	}
+	mExchanges.Lock()
+	defer mExchanges.Unlock()
+	if err := exchangeLog.Encode(x); err != nil {
+		logger.Println("===EXCHANGES===", err)
+	}
+}
+
+type exchangeKey struct{}
+
+// toolResultIDs returns the tool_use IDs of the tool_result blocks of a user message.
+func toolResultIDs(raw json.RawMessage) []string {
+	var msg struct {
+		Role    string
+		Content json.RawMessage
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil || msg.Role != "user" {
+		return nil
+	}
+	var blocks []struct {
+		Type      string
+		ToolUseID string `json:"tool_use_id"`
+	}
+	json.Unmarshal(msg.Content, &blocks)
+	var ids []string
+	for _, b := range blocks {
+		if b.Type == "tool_result" {
+			ids = append(ids, b.ToolUseID)
+		}
+	}
+	return ids
+}
+
+// promptOf returns the text of the last text block of a user message.
+func promptOf(raw json.RawMessage) string {
+	var msg struct {
+		Content json.RawMessage
+	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return ""
+	}
+	var text string
+	if err := json.Unmarshal(msg.Content, &text); err == nil {
+		return text
+	}
+	var blocks []struct {
+		Type string
+		Text string
+	}
+	json.Unmarshal(msg.Content, &blocks)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if blocks[i].Type == "text" {
+			return blocks[i].Text
+		}
+	}
+	return ""
+}
+
 type tr struct{}
 
 func (tr) RoundTrip(req *http.Request) (*http.Response, error) {
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	ctx, span := tracer.Start(req.Context(), "upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.full", req.URL.String()),
+	))
+	defer span.End()
+	resp, err := http.DefaultTransport.RoundTrip(req.WithContext(ctx))
 	if err != nil {
 		logger.Println("roundtrip error:", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
 	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	return resp, err
 }
 
@@ -99,64 +233,33 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 
 	s := &Proxy{
 		Server:  http.Server{Addr: addr},
-		manager: json.NewEncoder(managerConn),
+		manager: newManagerClient(managerConn),
 		cancel:  cancel,
+		tt:      NewToolsTracker(nil),
+		history: history.NewTracker(),
+		perTool: os.Getenv("COSMOS_SNAPSHOT") == "tool",
+		egress:  egressFromEnv(),
+		turns:   map[string]*snapshot.Turn{},
+	}
+	if hosts := domainList(os.Getenv("COSMOS_MITM")); len(hosts) > 0 {
+		s.mitm = M2(newMITM(hosts))
+	}
+	if name := os.Getenv("COSMOS_POLICY"); name != "" {
+		s.policy = M2(policy.Load(name))
+		logger.Printf("Policy loaded from %s: %d rules\n", name, len(s.policy.Rules))
 	}
 
-	// s.w, err = fsnotify.NewWatcher()
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// s.w.Add("/root/.claude/projects/-root-vibing")
-
-	// trackerCh := make(chan *ToolsTracker)
-
-	// // Start listening for fs events.
-	// go func() {
-	// 	for {
-	// 		select {
-	// 		case event, ok := <-s.w.Events:
-	// 			if !ok {
-	// 				return
-	// 			}
-	// 			if event.Has(fsnotify.Create) {
-	// 				name := event.Name
-	// 				if !strings.HasSuffix(name, ".jsonl") {
-	// 					log.Println("unexpected event", event.Name, event)
-	// 					continue
-	// 				}
-	// 				tt, err := ProcessLogFileForCompletions(event.Name)
-	// 				if err != nil {
-	// 					log.Printf("error processing log %q: %v", event.Name, err)
-	// 				}
-	// 				select {
-	// 				case trackerCh <- tt:
-	// 				}
-	// 				return
-	// 			}
-	// 		case err, ok := <-s.w.Errors:
-	// 			if !ok {
-	// 				return
-	// 			}
-	// 			log.Println("error:", err)
-	// 		}
-	// 	}
-	// }()
-
-	// var mTools sync.Mutex
-	// var toolsCh chan struct{}
-	// waitTools := make(chan struct{}, 1)
-	toolsQueue := &set{s: map[string]struct{}{}}
-	// toolsDone := &set{s: map[string]struct{}{}}
-
-	var allReqsData [][]byte
+	toolsQueue := &set{s: map[string]string{}}
 
 	proxy := &httputil.ReverseProxy{
 		Transport: tr{},
 		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The span includes the time spent waiting for the previous exchange to finish.
+			ctx, span := tracer.Start(pr.In.Context(), "proxy.rewrite")
+			defer span.End()
+
 			m.Lock()
 
-			ctx := pr.In.Context()
 			numRequests++
 			ct := pr.Out.Header.Get("Content-Type")
 			logger.Printf("=== [REQUEST %d: %s] ===\n\n", numRequests, ct)
@@ -165,7 +268,13 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 			var dupBody io.ReadCloser
 			pr.Out.Body, dupBody = rout.Readers[0], rout.Readers[1]
 
+			ex := &exchange{done: make(chan struct{}), start: time.Now()}
+			pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), exchangeKey{}, ex))
+
 			go func() {
+				ctx, span := tracer.Start(ctx, "proxy.inspect")
+				defer span.End()
+				defer close(ex.done)
 				defer rout.Close()
 				defer logger.Println("\n\nDONE REQUEST")
 				if ct != "application/json" {
@@ -174,103 +283,56 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 				}
 				var x struct {
 					Messages []json.RawMessage
+					System   json.RawMessage
+					Metadata struct {
+						UserID string `json:"user_id"`
+					}
 				}
 				NoEOF(json.NewDecoder(io.TeeReader(dupBody, logger.Writer())).Decode(&x))
-
-				switch len(x.Messages) {
-				case 0:
-					err := fmt.Errorf("unexpected number of messages: %d", len(x.Messages))
-					logger.Printf("===ERROR===: %v\n", err)
-					return
-				case 1:
+				if len(x.Messages) == 0 {
 					return
 				}
-				// Get the N-2 message: the user message that contains the last tool_result
-				var msg struct {
-					Role    string
-					Content json.RawMessage
-				}
-				M(json.Unmarshal([]byte(x.Messages[len(x.Messages)-3]), &msg))
-				if msg.Role != "user" {
-					logger.Printf("===ERROR===: expected role assistant got %q\n", msg.Role)
+				chain, err := history.NewChain(x.Messages)
+				if err != nil {
+					logger.Printf("===ERROR===: %v\n", err)
 					return
 				}
-				logger.Printf("===MSG===: %#v\n", msg)
-
-				// Only account for msg.Content, because other fields in msg can vary (notably "cache_control" field)
-				reqData := M2(json.Marshal(msg.Content))
-				// Remove '[' and ']' so we can manually JSON decode in a loop the common prefix which may not be at a valid JSON boundary.
-				reqData = reqData[1 : len(reqData)-1]
-				// reqData := M2(io.ReadAll(io.TeeReader(dupBody, logger.Writer())))
-				// M(json.Unmarshal(reqData, &x))
-				// Sometimes model is different, so match only starting from messages
-				// i := bytes.Index(reqData, []byte(`"messages":[`))
-				// reqData = reqData[i:]
-				// allReqsData = append(allReqsData, reqData)
-
-				if msg.Content[0] == '"' {
-					logger.Println("===STRCONTENT===", string(msg.Content))
+				ex.chain = chain
+
+				// Side requests (titles, subagents) use other system prompts, keep their conversations apart.
+				session := x.Metadata.UserID
+				if len(x.System) > 0 {
+					if h, err := history.Sum(x.System); err == nil {
+						session += "/" + h.String()
+					}
+				}
+				ex.session = session
+				fork, rewound := s.history.Observe(session, chain)
+				// Any snapshot taken before the assistant message preceding the fork is a restore point,
+				// the manager picks the most recent one on the current branch.
+				if rewound {
+					logger.Printf("===REWIND=== %s: back to message %d\n", session, fork)
+					s.load(ctx, chain[:max(fork-1, 0)], promptOf(x.Messages[len(x.Messages)-1]))
 					return
 				}
-				var contents []struct {
-					ToolUseID string
-					Type      string
-					Content   json.RawMessage
+
+				last := x.Messages[len(x.Messages)-1]
+				results := toolResultIDs(last)
+				if len(results) == 0 {
+					s.startTurn(session, promptOf(last))
 				}
-				M(json.Unmarshal(msg.Content, &contents))
-				logger.Println("===REQDATA===", string(reqData))
-				for i := len(contents) - 1; i >= 0; i-- {
-					content := contents[i]
-					logger.Printf("===CONTENT===: %+v\n", content)
-					if content.Type == "tool_result" {
-						logger.Println("===TOOL_RESULT===", content.ToolUseID)
-						// maxPrefixJ, maxPrefixLen := -1, 0
-						for j := len(allReqsData) - 1; j >= 0; j-- {
-							prevReqData := allReqsData[j]
-							logger.Println("===PREVREQDATA===", j, string(prevReqData))
-							prefix := CommonPrefixBytes(reqData, prevReqData)
-							// // Skip "[" to have a list of comma-separated JSON objects
-							r := bytes.NewReader(prefix)
-							// Maybe there's a faster way to extract the valid JSON objects from the []byte assuming the JSON has a list of valid objects
-							var v json.RawMessage
-							var n int
-							for {
-								d := json.NewDecoder(r)
-								if err := d.Decode(&v); err != nil {
-									break
-								}
-								// decode is successful, keep track how many bytes take up the valid JSONs so far
-								leftInBuf, _ := io.Copy(io.Discard, d.Buffered())
-								// total unread = unread bytes reader portion + what's still in JSON buffer
-								n = r.Len() + int(leftInBuf)
-								// skip ","
-								r.Seek(1, io.SeekCurrent)
-							}
 
-							prefix = prefix[:len(prefix)-n]
-							logger.Println("===PREFIX===", j, string(prefix))
-							if len(prefix) == len(prevReqData) {
-								logger.Println("===!!!!!===", j)
-								//&& len(prefix) > maxPrefixLen {
-								//maxPrefixLen = len(prefix)
-								// maxPrefixJ = j
-								M(json.Unmarshal([]byte(x.Messages[len(x.Messages)-1]), &msg))
-								var x []struct {
-									Type string
-									Text string
-								}
-								M(json.Unmarshal([]byte(msg.Content), &x))
-								prompt := x[len(x)-1].Text
-								s.load(len(allReqsData)-j, prompt)
-								// s.cancel()
-								return
-							}
+				// A request carrying the result of a queued tool_use means the tool has run.
+				if s.perTool {
+					var calls []string
+					for _, id := range results {
+						if call, ok := toolsQueue.Take(id); ok {
+							calls = append(calls, call)
 						}
-						allReqsData = append(allReqsData, reqData)
-						// if maxPrefixJ >= 0 {
-						// logger.Println("===!!!!!===", maxPrefixJ)
-						// }
-						break
+					}
+					if len(calls) > 0 {
+						s.waitTools(ctx)
+						s.commit(ctx, "after "+strings.Join(calls, ", "), chain.Head(), true, false, s.turn(session, nil))
 					}
 				}
 			}()
@@ -324,11 +386,21 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 				ct = mediaType
 			}
 
+			ex, _ := resp.Request.Context().Value(exchangeKey{}).(*exchange)
+			if ex == nil {
+				ex = &exchange{done: make(chan struct{})}
+				close(ex.done)
+			}
+			if s.policy != nil && ct == "text/event-stream" {
+				body = s.filterTools(resp.Request.Context(), body, ex)
+			}
+
 			rout := ctxio.NewReaderFanOut(ctx, io.NopCloser(body), 2)
 			var dupBody io.ReadCloser
 			resp.Body, dupBody = rout.Readers[0], io.NopCloser(io.TeeReader(rout.Readers[1], logger.Writer()))
 
 			if ct != "text/event-stream" {
+				logExchange(resp, transcript.Exchange{})
 				logger.Printf("=== RESPONSE [%d] ===\n\n", numRequests)
 				go func() {
 					defer logger.Println("\n\nDONE RESPONSE")
@@ -342,18 +414,12 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 
 			// TODO: context?
 			go func() {
+				ctx, span := tracer.Start(resp.Request.Context(), "sse.stream")
+				defer span.End()
 				defer rout.Close()
 				defer m.Unlock()
 				encodingBase64 := false
 				msg := new(anthropic.Message)
-
-				// logger.Println("\n\nWaiting for tracker")
-				// wait for session file to be created
-				// var tt *ToolsTracker
-				// select {
-				// case tt = <-trackerCh:
-				// }
-				// logger.Println("\n\nTracker found")
 				for {
 					p, err := sseReader.ReadEvent()
 					if err != nil {
@@ -365,17 +431,28 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 					M(msg.Accumulate(ev))
 					if _, ok := ev.AsAny().(anthropic.MessageStopEvent); ok {
 						logger.Println("\n\n===TOTO===", msg)
+						span.AddEvent("message_stop", trace.WithAttributes(attribute.String("stop_reason", string(msg.StopReason))))
+						logExchange(resp, transcript.Exchange{
+							Model:      string(msg.Model),
+							StopReason: string(msg.StopReason),
+							Usage: transcript.Usage{
+								InputTokens:              msg.Usage.InputTokens,
+								OutputTokens:             msg.Usage.OutputTokens,
+								CacheCreationInputTokens: msg.Usage.CacheCreationInputTokens,
+								CacheReadInputTokens:     msg.Usage.CacheReadInputTokens,
+							},
+						})
 						toolUseID := ""
-						// Just in case Claude does not accumulate like we do, and starts executing tools as it streams partial json
-						// there could be a race, where Claude executes a tool, writes to jsonlog before we get to AddPendingTool.
-						// FIXME: Tracker should not delete from a map, it should just have 2 maps: one for what's gonna be executed
-						// one for what's been executed, and we should compare the two.
+						<-ex.done
+						turn := s.turn(ex.session, msg)
+						// Claude may start executing tools while it streams partial json, and log their results before
+						// we get to AddPendingTool: the tracker keeps those completions and matches them here.
 						for _, content := range msg.Content {
 							if content.Type == "tool_use" {
 								// For some reason msg.ToolUseID is empty
 								toolUseID = content.ID
-								toolsQueue.Add(toolUseID)
-								// tt.AddPendingTool(toolUseID)
+								toolsQueue.Add(toolUseID, snapshot.NewToolCall(content.Name, content.Input).String())
+								s.tt.AddPendingTool(toolUseID)
 								logger.Printf("FOUND EVENT: %s: %v\n", event.Event, toolUseID)
 							}
 						}
@@ -385,11 +462,12 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 							logger.Println("acquiring commit lock")
 							toolsQueue.m.Lock()
 							if len(toolsQueue.s) > 0 {
-								// TODO: find summary of what was done, or make the commits per tool use
-								s.commit(toolUseID)
+								s.waitTools(ctx)
+								s.commit(ctx, turn.Message(), ex.chain.Head(), false, true, turn)
 							}
+							s.endTurn(ex.session)
 							logger.Println("committing ", toolsQueue.s)
-							toolsQueue.s = map[string]struct{}{}
+							toolsQueue.s = map[string]string{}
 							toolsQueue.m.Unlock()
 							logger.Println("releasing commit lock")
 						}
@@ -404,12 +482,22 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodConnect {
-			w.WriteHeader(http.StatusBadGateway)
-			s.Shutdown(context.Background())
-			// handleConnect(w, r)
+			s.handleConnect(w, r)
 			return
 		}
-		proxy.ServeHTTP(w, r)
+		if r.URL.IsAbs() {
+			// Requests for other hosts, from tools using the proxy as their HTTP_PROXY.
+			s.handleForward(w, r)
+			return
+		}
+		ctx, span := tracer.Start(otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header)), "agent.request",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+		proxy.ServeHTTP(w, r.WithContext(ctx))
 	}
 
 	s.Handler = http.HandlerFunc(handler)
@@ -437,42 +525,111 @@ func startProxy(addr string, managerConn net.Conn, cancel context.CancelFunc) *P
 	return s
 }
 
-func (p *Proxy) load(historyIndex int, prompt string) {
-	var x = struct {
-		Action string
-		Data   struct {
-			N      int
-			Prompt string
-		}
-	}{
-		"load",
-		struct {
-			N      int
-			Prompt string
-		}{historyIndex, prompt},
+// load asks the manager to restart the agent with prompt from the latest snapshot
+// taken at one of the conversation points of restore.
+func (p *Proxy) load(ctx context.Context, restore history.Chain, prompt string) {
+	ctx, span := tracer.Start(ctx, "proxy.load", trace.WithAttributes(attribute.Int("messages", len(restore))))
+	defer span.End()
+	hashes := make([]string, len(restore))
+	for i, h := range restore {
+		hashes[i] = h.String()
 	}
 	logger.Println("Sending load instruction")
-	if err := p.manager.Encode(x); err == io.EOF {
+	p.send(ctx, "load", struct {
+		Hashes []string
+		Prompt string
+	}{hashes, prompt})
+}
+
+// send sends an instruction to the manager, stopping the proxy if the manager is gone.
+func (p *Proxy) send(ctx context.Context, action string, data any) {
+	if err := p.manager.Send(ctx, action, data); err == io.EOF {
 		p.cancel()
 	} else if err != nil {
 		panic(err)
 	}
 }
 
-func (p *Proxy) commit(comment string) {
-	var x = struct {
-		Action string
-		Data   string
-	}{
-		"commit",
-		comment,
+// startTurn begins a new turn of session with the user prompt.
+func (p *Proxy) startTurn(session, prompt string) {
+	p.mTurns.Lock()
+	p.turns[session] = &snapshot.Turn{Prompt: prompt}
+	p.mTurns.Unlock()
+}
+
+// turn adds the tool calls, usage and text of the assistant message msg, if any,
+// to the turn in progress in session and returns a copy of it.
+func (p *Proxy) turn(session string, msg *anthropic.Message) *snapshot.Turn {
+	p.mTurns.Lock()
+	defer p.mTurns.Unlock()
+	t, ok := p.turns[session]
+	if !ok {
+		t = &snapshot.Turn{}
+		p.turns[session] = t
+	}
+	if msg != nil {
+		var text []string
+		for _, content := range msg.Content {
+			switch content.Type {
+			case "tool_use":
+				t.Tools = append(t.Tools, snapshot.NewToolCall(content.Name, content.Input))
+			case "text":
+				text = append(text, content.Text)
+			}
+		}
+		if len(text) > 0 {
+			t.Text = snapshot.Excerpt(strings.Join(text, " "), 500)
+		}
+		t.Usage.Add(snapshot.Usage{
+			InputTokens:              msg.Usage.InputTokens,
+			OutputTokens:             msg.Usage.OutputTokens,
+			CacheReadInputTokens:     msg.Usage.CacheReadInputTokens,
+			CacheCreationInputTokens: msg.Usage.CacheCreationInputTokens,
+		})
+	}
+	c := *t
+	c.Tools = slices.Clone(t.Tools)
+	return &c
+}
+
+func (p *Proxy) endTurn(session string) {
+	p.mTurns.Lock()
+	delete(p.turns, session)
+	p.mTurns.Unlock()
+}
+
+// commit asks the manager for a snapshot, taken at conversation point at unless it is zero.
+// With ifChanged, the manager skips the snapshot if the container filesystem didn't change since the last one.
+// endTurn tells the snapshot is the one of the end of a turn, which the manager may verify.
+func (p *Proxy) commit(ctx context.Context, comment string, at history.Hash, ifChanged, endTurn bool, turn *snapshot.Turn) {
+	ctx, span := tracer.Start(ctx, "proxy.commit")
+	defer span.End()
+	var hash string
+	if !at.IsZero() {
+		hash = at.String()
 	}
 	logger.Println("Sending commit instruction")
-	if err := p.manager.Encode(x); err == io.EOF {
-		p.cancel()
-	} else if err != nil {
-		panic(err)
+	p.send(ctx, "commit", commitData{comment, hash, ifChanged, endTurn, turn})
+}
+
+type commitData struct {
+	Message   string
+	Hash      string
+	IfChanged bool
+	EndTurn   bool
+	Turn      *snapshot.Turn
+}
+
+// commitSync is commit, returning once the snapshot is taken.
+func (p *Proxy) commitSync(ctx context.Context, comment string, at history.Hash, turn *snapshot.Turn) error {
+	ctx, span := tracer.Start(ctx, "proxy.commit_sync")
+	defer span.End()
+	var hash string
+	if !at.IsZero() {
+		hash = at.String()
 	}
+	logger.Println("Sending commit instruction, waiting for the snapshot")
+	return p.manager.Call(ctx, "commit", commitData{comment, hash, false, false, turn}, nil)
 }
 
 // Client should not be Client but the subject of the manager
@@ -486,10 +643,21 @@ func startManagerClient(addr string) net.Conn {
 }
 
 func main() {
+	// Log to a file instead of stdout to avoid conflicts with Claude's TUI
+	logFile := M2(os.OpenFile("/cosmos/proxy.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644))
+	logger = log.New(logFile, "\n[PROXY] ", log.LstdFlags)
+	exchangeLog = json.NewEncoder(M2(os.OpenFile("/cosmos/exchanges.jsonl", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)))
+
 	logger.Println("Starting proxy...", isatty.IsTerminal(os.Stdin.Fd()))
 	defer logger.Println("Proxy shutdown complete")
 	ctx, cancel := context.WithCancel(context.Background())
 
+	shutdownTracing, err := tracing.Init(ctx, "cosmos-proxy")
+	if err != nil {
+		logger.Println("tracing disabled:", err)
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
 	// ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	// defer func() {
 	// 	if x := recover(); x != nil {
@@ -498,13 +666,14 @@ func main() {
 	// 	stop()
 	// }()
 
-	managerAddr := "0.0.0.0:8042"
+	// The ports are the container's own, the host maps them to free ones, so sessions don't collide.
+	managerAddr := "0.0.0.0:" + envOr("COSMOS_MANAGER_PORT", "8042")
 	logger.Println("START", managerAddr)
 	managerConn := startManagerClient(managerAddr)
 
 	logger.Println("Client started")
 
-	proxyAddr := "localhost:8080"
+	proxyAddr := "localhost:" + envOr("COSMOS_PROXY_PORT", "8080")
 	proxy := startProxy(proxyAddr, managerConn, cancel)
 
 	logger.Println("Proxy started")
@@ -516,6 +685,72 @@ func main() {
 	claudeCmd.Stdout = os.Stdout
 	claudeCmd.Stderr = os.Stderr
 
+	home := M2(os.UserHomeDir())
+	var agent *user.User
+	if os.Getuid() == 0 {
+		// The proxy keeps root to own the firewall and the trust store, claude runs as an unprivileged user.
+		agent = M2(user.Lookup("cosmos"))
+		uid, gid := M2(strconv.Atoi(agent.Uid)), M2(strconv.Atoi(agent.Gid))
+		home = agent.HomeDir
+		claudeCmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+		claudeCmd.Env = append(claudeCmd.Env, "HOME="+home, "USER="+agent.Username, "LOGNAME="+agent.Username)
+	}
+	logger.Printf("Network mode %s, allowed: %v, denied: %v\n", proxy.egress.mode, proxy.egress.allow, proxy.egress.deny)
+	if agent == nil && proxy.egress.restricted() {
+		panic("network mode " + proxy.egress.mode + " needs the proxy to run as root")
+	}
+	if agent == nil {
+		logger.Println("===EGRESS=== not running as root, the connections bypassing the proxy are not reported")
+	} else {
+		// In the full network mode too, so that the connections bypassing the proxy are reported.
+		M(setupFirewall(M2(strconv.Atoi(agent.Uid)), !proxy.egress.restricted()))
+		go func() {
+			if err := proxy.trapEgress(ctx); err != nil && ctx.Err() == nil {
+				logger.Println("===EGRESS=== trap stopped:", err)
+			}
+		}()
+	}
+	if os.Getenv("COSMOS_MOUNT") == "overlay" {
+		if agent == nil {
+			panic("the overlay mount needs the proxy to run as root")
+		}
+		wd := M2(os.Getwd())
+		M(mountOverlay(wd, M2(strconv.Atoi(agent.Uid)), M2(strconv.Atoi(agent.Gid))))
+		// The proxy's working directory is still the one under the mount.
+		claudeCmd.Dir = wd
+		logger.Println("Workdir mounted as an overlay")
+	}
+	if proxy.mitm != nil {
+		logger.Printf("Intercepting TLS to %v\n", proxy.mitm.hosts)
+		if agent == nil {
+			panic("TLS interception needs the proxy to run as root")
+		}
+		M(proxy.mitm.installCA())
+		// Node and Python don't use the system trust store by default.
+		claudeCmd.Env = append(claudeCmd.Env, "NODE_EXTRA_CA_CERTS="+mitmCAFile, "SSL_CERT_FILE="+systemCAs, "REQUESTS_CA_BUNDLE="+systemCAs)
+	}
+	// The tools honoring the proxy variables have their traffic audited, and filtered by the network rules.
+	claudeCmd.Env = append(claudeCmd.Env, "HTTPS_PROXY=http://"+proxyAddr, "HTTP_PROXY=http://"+proxyAddr, "NO_PROXY=localhost,127.0.0.1")
+
+	// Claude logs tool results to its session files once the tools have run.
+	sessionsDir := transcript.ProjectDir(home, M2(os.Getwd()))
+	if agent != nil {
+		// Created by root, the directories would not be writable by claude.
+		M(mkdirAllAs(sessionsDir, home, agent))
+	}
+	go func() {
+		if err := watchSessions(ctx, sessionsDir, proxy.tt); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Println("===SESSIONS=== stopped watching:", err)
+		}
+	}()
+	completions, unsubscribe := proxy.tt.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for ev := range completions {
+			logger.Printf("===TOOLS=== %s completed at %s (line %d)\n", ev.ToolID, ev.Timestamp.Format(time.RFC3339), ev.LineNo)
+		}
+	}()
+
 	logger.Println(claudeCmd.Env)
 
 	// Create a channel to receive OS signals.
@@ -537,7 +772,10 @@ func main() {
 	}()
 
 	// Run claude and wait for it to complete
-	err := claudeCmd.Run()
+	err = claudeCmd.Run()
+
+	// Spans are batched, flush them before exiting.
+	shutdownTracing(context.Background())
 
 	// Exit with claude's exit code
 	if err != nil {
@@ -553,14 +791,10 @@ func main() {
 	}
 }
 
-func CommonPrefixBytes(a, b []byte) []byte {
-	minLen := len(a)
-	if len(b) < minLen {
-		minLen = len(b)
-	}
-	i := 0
-	for i < minLen && a[i] == b[i] {
-		i++
+// envOr returns the value of the environment variable key, or def if it is empty.
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
 	}
-	return a[:i]
+	return def
 }
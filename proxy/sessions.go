@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// tailer reads the lines appended to a file. An incomplete last line is kept
+// until the rest of it is written, and a truncated or replaced file is read
+// again from the start.
+type tailer struct {
+	path    string
+	f       *os.File
+	offset  int64
+	partial []byte
+	lineNo  int
+}
+
+// newTailer starts tailing path, from its current end unless fromStart is set.
+func newTailer(path string, fromStart bool) (*tailer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &tailer{path: path, f: f}
+	if !fromStart {
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		t.offset = fi.Size()
+	}
+	return t, nil
+}
+
+// ReadLines calls fn with every complete line written since the last call.
+func (t *tailer) ReadLines(fn func(line []byte, lineNo int)) error {
+	if err := t.reopenIfReplaced(); err != nil {
+		return err
+	}
+	fi, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < t.offset {
+		t.offset, t.partial, t.lineNo = 0, nil, 0
+	}
+	buf, err := io.ReadAll(io.NewSectionReader(t.f, t.offset, fi.Size()-t.offset))
+	if err != nil {
+		return err
+	}
+	t.offset += int64(len(buf))
+	buf = append(t.partial, buf...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		t.lineNo++
+		if line := bytes.TrimSpace(buf[:i]); len(line) > 0 {
+			fn(line, t.lineNo)
+		}
+		buf = buf[i+1:]
+	}
+	t.partial = append([]byte(nil), buf...)
+	return nil
+}
+
+func (t *tailer) reopenIfReplaced() error {
+	cur, err := t.f.Stat()
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(t.path)
+	if err != nil || os.SameFile(cur, fi) {
+		return nil
+	}
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	t.f.Close()
+	t.f, t.offset, t.partial, t.lineNo = f, 0, nil, 0
+	return nil
+}
+
+func (t *tailer) Close() error {
+	return t.f.Close()
+}
+
+// watchSessions feeds the session logs written in dir to tt until ctx is done.
+// Logs present at startup are followed from their current end, new ones from their start.
+func watchSessions(ctx context.Context, dir string, tt *ToolsTracker) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := w.Add(dir); err != nil {
+		return err
+	}
+
+	tailers := map[string]*tailer{}
+	defer func() {
+		for _, t := range tailers {
+			t.Close()
+		}
+	}()
+	follow := func(path string, fromStart bool) {
+		t, ok := tailers[path]
+		if !ok {
+			var err error
+			if t, err = newTailer(path, fromStart); err != nil {
+				logger.Printf("===SESSIONS=== cannot tail %s: %v\n", path, err)
+				return
+			}
+			logger.Println("===SESSIONS=== following", path)
+			tailers[path] = t
+		}
+		err := t.ReadLines(func(line []byte, lineNo int) {
+			if err := tt.ProcessLine(line, lineNo); err != nil {
+				logger.Printf("===SESSIONS=== %s:%d: %v\n", path, lineNo, err)
+			}
+		})
+		if err != nil {
+			logger.Printf("===SESSIONS=== reading %s: %v\n", path, err)
+		}
+	}
+
+	existing, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, path := range existing {
+		follow(path, false)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if !strings.HasSuffix(event.Name, ".jsonl") {
+				continue
+			}
+			switch {
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				if t, ok := tailers[event.Name]; ok {
+					t.Close()
+					delete(tailers, event.Name)
+				}
+			case event.Has(fsnotify.Create), event.Has(fsnotify.Write):
+				follow(event.Name, true)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// Events were lost, catch up with every log.
+				for path := range tailers {
+					follow(path, true)
+				}
+			}
+			logger.Println("===SESSIONS=== watch error:", err)
+		}
+	}
+}
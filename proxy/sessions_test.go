@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := newTailer(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close()
+
+	var lines []string
+	read := func() []string {
+		t.Helper()
+		lines = nil
+		if err := tl.ReadLines(func(line []byte, lineNo int) { lines = append(lines, string(line)) }); err != nil {
+			t.Fatal(err)
+		}
+		return lines
+	}
+	appendFile := func(s string) {
+		t.Helper()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	appendFile("a\nb")
+	if got := read(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("got %q, want only the complete line", got)
+	}
+	appendFile("c\n")
+	if got := read(); !reflect.DeepEqual(got, []string{"bc"}) {
+		t.Fatalf("got %q, want the completed partial line", got)
+	}
+
+	if err := os.WriteFile(path, []byte("d\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); !reflect.DeepEqual(got, []string{"d"}) {
+		t.Fatalf("got %q after truncation", got)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte("e\nf\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); !reflect.DeepEqual(got, []string{"e", "f"}) {
+		t.Fatalf("got %q after replacement", got)
+	}
+}
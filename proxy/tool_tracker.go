@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/tiborvass/cosmos/transcript"
 )
 
 // ToolCompletionEvent represents when a tool finishes execution
@@ -16,167 +21,191 @@ type ToolCompletionEvent struct {
 	LineNo    int
 }
 
-// LogEntry represents Claude project log structure
-// Expected structure from ~/.claude/projects/-Users-home-cosmos/*.jsonl:
-// {"type":"user","message":{"role":"user","content":[{"tool_use_id":"toolu_123","type":"tool_result","content":"..."}]},"timestamp":"..."}
-// or
-// {"type":"assistant","message":{"role":"assistant","content":[{"type":"tool_use","id":"toolu_123","name":"Read","input":{"file_path":"..."}}]},"timestamp":"..."}
-type LogEntry struct {
-	Type      string    `json:"type"`
-	UUID      string    `json:"uuid"`
-	Timestamp time.Time `json:"timestamp"`
-	Message   *Message  `json:"message,omitempty"`
+// ToolsTracker efficiently streams and detects tool completions.
+//
+// The proxy expects a tool when it sees its tool_use in a response, and Claude logs
+// its completion once the tool has run. Both are recorded separately because the
+// completion may be logged before the tool is expected, and forgotten once the
+// completion is delivered. Completions never expected are forgotten after
+// unexpectedTTL.
+type ToolsTracker struct {
+	m         sync.RWMutex
+	expected  map[string]struct{}
+	completed map[string]ToolCompletionEvent
+	subs      map[chan ToolCompletionEvent]struct{}
+	changed   chan struct{} // closed and replaced whenever a tool completes
 }
 
-// MessageContent represents content within a message
-// For tool_use: {"type":"tool_use","id":"toolu_123","name":"Read","input":{...}}
-// For tool_result: {"type":"tool_result","tool_use_id":"toolu_123","content":"..."}
-type MessageContent struct {
-	Type      string `json:"type"`
-	ID        string `json:"id,omitempty"`          // For tool_use entries
-	ToolUseID string `json:"tool_use_id,omitempty"` // For tool_result entries
-	Name      string `json:"name,omitempty"`        // Tool name for tool_use
-	Content   string `json:"content,omitempty"`     // Result content for tool_result
-}
+// unexpectedTTL is how long a completion waits for its tool to be expected.
+const unexpectedTTL = 10 * time.Minute
 
-type Message struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content,omitempty"` // Can be string or []MessageContent
-}
-
-// ToolsTracker efficiently streams and detects tool completions
-type ToolsTracker struct {
-	pendingToolIDs map[string]struct{}
-	ch             chan ToolCompletionEvent
-	m              sync.RWMutex
-}
+// subscriberBuffer is the number of events a subscriber can fall behind before events are dropped for it.
+const subscriberBuffer = 64
 
 // NewToolsTracker creates a tracker with known pending tool IDs
 func NewToolsTracker(pendingToolIDs map[string]struct{}) *ToolsTracker {
-	if pendingToolIDs == nil {
-		pendingToolIDs = map[string]struct{}{}
+	tc := &ToolsTracker{
+		expected:  map[string]struct{}{},
+		completed: map[string]ToolCompletionEvent{},
+		subs:      map[chan ToolCompletionEvent]struct{}{},
+		changed:   make(chan struct{}),
 	}
-	return &ToolsTracker{
-		pendingToolIDs: pendingToolIDs,
-		ch:             make(chan ToolCompletionEvent, 1),
+	for id := range pendingToolIDs {
+		tc.expected[id] = struct{}{}
 	}
+	return tc
 }
 
-// AddPendingTool adds a tool ID to track for completion
+// AddPendingTool adds a tool ID to track for completion. A completion already
+// logged for it is notified right away.
 func (tc *ToolsTracker) AddPendingTool(toolID string) {
 	if tc == nil || toolID == "" {
 		return
 	}
 	tc.m.Lock()
 	defer tc.m.Unlock()
-	tc.pendingToolIDs[toolID] = struct{}{}
+	if _, ok := tc.expected[toolID]; ok {
+		return
+	}
+	tc.expected[toolID] = struct{}{}
+	if ev, ok := tc.completed[toolID]; ok {
+		tc.deliver(ev)
+	}
+}
+
+// deliver notifies the completion of an expected tool and forgets both. It must
+// be called with tc.m held.
+func (tc *ToolsTracker) deliver(ev ToolCompletionEvent) {
+	delete(tc.expected, ev.ToolID)
+	delete(tc.completed, ev.ToolID)
+	tc.notify(ev)
+}
+
+// Subscribe returns a channel receiving the completions of expected tools and a
+// function to stop receiving them. Events are dropped rather than blocking the
+// tracker when the subscriber falls behind.
+func (tc *ToolsTracker) Subscribe() (<-chan ToolCompletionEvent, func()) {
+	ch := make(chan ToolCompletionEvent, subscriberBuffer)
+	tc.m.Lock()
+	tc.subs[ch] = struct{}{}
+	tc.m.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			tc.m.Lock()
+			delete(tc.subs, ch)
+			tc.m.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// notify must be called with tc.m held.
+func (tc *ToolsTracker) notify(ev ToolCompletionEvent) {
+	for ch := range tc.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	close(tc.changed)
+	tc.changed = make(chan struct{})
 }
 
-// StreamAndDetectCompletions efficiently parses JSONL stream to detect tool completions
+// StreamAndDetectCompletions parses a JSONL stream line by line to detect tool
+// completions. Malformed lines are reported and skipped.
 func (tc *ToolsTracker) StreamAndDetectCompletions(reader io.Reader) error {
-	decoder := json.NewDecoder(reader)
+	if reader == nil {
+		return fmt.Errorf("nil reader")
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 64<<20)
 	lineNo := 0
 	var lastError error
-
-	for {
-		var entry LogEntry
-		if err := decoder.Decode(&entry); err != nil {
-			if err == io.EOF {
-				break
-			}
-			// Log error but continue processing if possible
-			fmt.Fprintf(os.Stderr, "WARNING: Failed to decode JSON at line %d: %v\n", lineNo+1, err)
-			lastError = err
-			// Skip malformed JSON and continue
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
 			continue
 		}
-
-		lineNo++
-
-		// Check if this is a tool_result entry (indicates tool completion)
-		if entry.Type == "user" && entry.Message != nil && entry.Message.Role == "user" {
-			// Content can be string or []interface{}, we only care about arrays
-			if contentArray, ok := entry.Message.Content.([]interface{}); ok {
-				tc.checkForToolResults(contentArray, entry.Timestamp, lineNo)
-			}
+		if err := tc.ProcessLine(line, lineNo); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: Failed to decode JSON at line %d: %v\n", lineNo, err)
+			lastError = err
 		}
 	}
-
+	if err := scanner.Err(); err != nil {
+		return err
+	}
 	if lastError != nil {
 		return fmt.Errorf("stream processing completed with errors, last error: %w", lastError)
 	}
 	return nil
 }
 
-// checkForToolResults looks for tool_result content indicating tool completion
-func (tc *ToolsTracker) checkForToolResults(content []interface{}, timestamp time.Time, lineNo int) {
-	if tc == nil || content == nil {
-		return
+// ProcessLine detects tool completions in a single line of a JSONL log
+func (tc *ToolsTracker) ProcessLine(line []byte, lineNo int) error {
+	var entry transcript.Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return fmt.Errorf("failed to decode JSON: %w", err)
 	}
+	tc.processEntry(&entry, lineNo)
+	return nil
+}
 
-	for _, item := range content {
-		if item == nil {
-			continue
-		}
-
-		// Convert interface{} to map to access fields
-		itemMap, ok := item.(map[string]interface{})
-		if !ok {
-			continue
-		}
-
-		// Check if this is a tool_result type
-		itemType, exists := itemMap["type"]
-		if !exists || itemType != "tool_result" {
-			continue
-		}
-
-		// Extract tool_use_id
-		toolUseID, exists := itemMap["tool_use_id"]
-		if !exists {
-			continue
-		}
-
-		toolIDStr, ok := toolUseID.(string)
-		if !ok || toolIDStr == "" {
-			continue
-		}
-
-		// Check if we're tracking this tool
-		if !tc.isPendingTool(toolIDStr) {
+func (tc *ToolsTracker) processEntry(entry *transcript.Entry, lineNo int) {
+	// A tool_result entry indicates tool completion
+	if entry.Type != "user" || entry.Message == nil || entry.Message.Role != "user" {
+		return
+	}
+	for _, block := range entry.Message.Content {
+		if block.Type != "tool_result" || block.ToolUseID == "" {
 			continue
 		}
-
-		// Tool has completed
-		tc.markToolCompleted(toolIDStr)
-
-		tc.ch <- ToolCompletionEvent{
-			ToolID:    toolIDStr,
-			Timestamp: timestamp,
+		tc.complete(ToolCompletionEvent{
+			ToolID:    block.ToolUseID,
+			Timestamp: entry.Timestamp,
 			LineNo:    lineNo,
+		})
+	}
+}
+
+// complete records the completion of a tool, notifying subscribers if the tool is expected
+func (tc *ToolsTracker) complete(ev ToolCompletionEvent) {
+	tc.m.Lock()
+	defer tc.m.Unlock()
+	if _, ok := tc.completed[ev.ToolID]; ok {
+		return
+	}
+	if _, ok := tc.expected[ev.ToolID]; ok {
+		tc.deliver(ev)
+		return
+	}
+	for id, old := range tc.completed {
+		if time.Since(old.Timestamp) > unexpectedTTL {
+			delete(tc.completed, id)
 		}
 	}
+	tc.completed[ev.ToolID] = ev
 }
 
-// isPendingTool checks if a tool ID is pending completion
+// isPendingTool checks if a tool ID is expected and not completed yet
 func (tc *ToolsTracker) isPendingTool(toolID string) bool {
 	if tc == nil || toolID == "" {
 		return false
 	}
 	tc.m.RLock()
 	defer tc.m.RUnlock()
-	_, exists := tc.pendingToolIDs[toolID]
-	return exists
+	_, expected := tc.expected[toolID]
+	_, completed := tc.completed[toolID]
+	return expected && !completed
 }
 
-// markToolCompleted removes tool from pending list
+// markToolCompleted considers a tool completed without its completion being logged
 func (tc *ToolsTracker) markToolCompleted(toolID string) {
 	if tc == nil || toolID == "" {
 		return
 	}
-	tc.m.Lock()
-	defer tc.m.Unlock()
-	delete(tc.pendingToolIDs, toolID)
+	tc.complete(ToolCompletionEvent{ToolID: toolID, Timestamp: time.Now()})
 }
 
 // GetPendingTools returns copy of currently pending tool IDs
@@ -188,22 +217,34 @@ func (tc *ToolsTracker) GetPendingTools() map[string]struct{} {
 	defer tc.m.RUnlock()
 
 	result := make(map[string]struct{})
-	for id := range tc.pendingToolIDs {
-		result[id] = struct{}{}
+	for id := range tc.expected {
+		if _, ok := tc.completed[id]; !ok {
+			result[id] = struct{}{}
+		}
 	}
 	return result
 }
 
-func (tc *ToolsTracker) Wait() {
+// Wait blocks until every expected tool has completed or ctx is done
+func (tc *ToolsTracker) Wait(ctx context.Context) error {
 	for {
-		func() {
-			tc.m.Lock()
-			defer tc.m.Unlock()
-			if len(tc.pendingToolIDs) == 0 {
-				return
+		tc.m.RLock()
+		changed := tc.changed
+		pending := 0
+		for id := range tc.expected {
+			if _, ok := tc.completed[id]; !ok {
+				pending++
 			}
-			time.Sleep(time.Second)
-		}()
+		}
+		tc.m.RUnlock()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
 	}
 }
 
@@ -46,10 +46,7 @@ func TestExtendedToolCorrelator(t *testing.T) {
 
 		var completedTools []ToolCompletionEvent
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			tool := <-correlator.ch
-			completedTools = append(completedTools, tool)
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Capture stderr to verify error logging
 		old := os.Stderr
@@ -63,6 +60,10 @@ func TestExtendedToolCorrelator(t *testing.T) {
 
 		reader := strings.NewReader(jsonlStream)
 		err := correlator.StreamAndDetectCompletions(reader)
+		unsubscribe()
+		for ev := range events {
+			completedTools = append(completedTools, ev)
+		}
 
 		w.Close()
 		os.Stderr = old
@@ -94,16 +95,17 @@ func TestExtendedToolCorrelator(t *testing.T) {
 
 		var completedTools []ToolCompletionEvent
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			tool := <-correlator.ch
-			completedTools = append(completedTools, tool)
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Multiple tool results in one message
 		jsonlStream := `{"type":"user","message":{"role":"user","content":[{"tool_use_id":"toolu_nested1","type":"tool_result","content":"Result 1"},{"tool_use_id":"toolu_nested2","type":"tool_result","content":"Result 2"},{"type":"text","text":"Some text"}]},"timestamp":"2025-06-03T21:48:07.681Z"}`
 
 		reader := strings.NewReader(jsonlStream)
 		err := correlator.StreamAndDetectCompletions(reader)
+		unsubscribe()
+		for ev := range events {
+			completedTools = append(completedTools, ev)
+		}
 		if err != nil {
 			t.Fatalf("StreamAndDetectCompletions failed: %v", err)
 		}
@@ -131,16 +133,17 @@ func TestExtendedToolCorrelator(t *testing.T) {
 
 		var completedTools []ToolCompletionEvent
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			tool := <-correlator.ch
-			completedTools = append(completedTools, tool)
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Test various edge cases
 		jsonlStream := `{"type":"user","message":{"role":"user","content":[null,{"tool_use_id":"toolu_edge","type":"tool_result","content":"Result"},{"type":"tool_result"},{"tool_use_id":123,"type":"tool_result"}]},"timestamp":"2025-06-03T21:48:07.681Z"}`
 
 		reader := strings.NewReader(jsonlStream)
 		err := correlator.StreamAndDetectCompletions(reader)
+		unsubscribe()
+		for ev := range events {
+			completedTools = append(completedTools, ev)
+		}
 		if err != nil {
 			t.Fatalf("StreamAndDetectCompletions failed: %v", err)
 		}
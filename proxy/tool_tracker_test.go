@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"testing"
 	"time"
@@ -17,10 +19,7 @@ func TestToolCompletionCorrelator(t *testing.T) {
 		var completedTools []ToolCompletionEvent
 
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			tool := <-correlator.ch
-			completedTools = append(completedTools, tool)
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Simulated JSONL stream with tool completion
 		jsonlStream := `{"type":"user","message":{"role":"user","content":[{"tool_use_id":"toolu_01SsyiDXrX6JQ9XHU285Jgo3","type":"tool_result","content":"File content here"}]},"timestamp":"2025-06-03T21:48:07.681Z"}
@@ -28,6 +27,10 @@ func TestToolCompletionCorrelator(t *testing.T) {
 
 		reader := strings.NewReader(jsonlStream)
 		err := correlator.StreamAndDetectCompletions(reader)
+		unsubscribe()
+		for ev := range events {
+			completedTools = append(completedTools, ev)
+		}
 		if err != nil {
 			t.Fatalf("StreamAndDetectCompletions failed: %v", err)
 		}
@@ -62,16 +65,17 @@ func TestToolCompletionCorrelator(t *testing.T) {
 		var completedTools []ToolCompletionEvent
 
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			tool := <-correlator.ch
-			completedTools = append(completedTools, tool)
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Stream with unknown tool completion
 		jsonlStream := `{"type":"user","message":{"role":"user","content":[{"tool_use_id":"toolu_unknown","type":"tool_result","content":"Result"}]},"timestamp":"2025-06-03T21:48:07.681Z"}`
 
 		reader := strings.NewReader(jsonlStream)
 		err := correlator.StreamAndDetectCompletions(reader)
+		unsubscribe()
+		for ev := range events {
+			completedTools = append(completedTools, ev)
+		}
 		if err != nil {
 			t.Fatalf("StreamAndDetectCompletions failed: %v", err)
 		}
@@ -95,10 +99,7 @@ func TestToolCompletionCorrelator(t *testing.T) {
 
 		var completedTools []ToolCompletionEvent
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			tool := <-correlator.ch
-			completedTools = append(completedTools, tool)
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Stream with various non-tool-result entries
 		jsonlStream := `{"type":"assistant","message":{"role":"assistant","content":[{"type":"text","text":"Some response"}]},"timestamp":"2025-06-03T21:48:07.681Z"}
@@ -107,6 +108,10 @@ func TestToolCompletionCorrelator(t *testing.T) {
 
 		reader := strings.NewReader(jsonlStream)
 		err := correlator.StreamAndDetectCompletions(reader)
+		unsubscribe()
+		for ev := range events {
+			completedTools = append(completedTools, ev)
+		}
 		if err != nil {
 			t.Fatalf("StreamAndDetectCompletions failed: %v", err)
 		}
@@ -125,10 +130,7 @@ func TestToolCompletionCorrelator(t *testing.T) {
 
 		var completionCount int
 		correlator := NewToolsTracker(pendingTools)
-		go func() {
-			<-correlator.ch
-			completionCount++
-		}()
+		events, unsubscribe := correlator.Subscribe()
 
 		// Generate large JSONL stream
 		var jsonlLines []string
@@ -144,6 +146,10 @@ func TestToolCompletionCorrelator(t *testing.T) {
 		start := time.Now()
 		err := correlator.StreamAndDetectCompletions(reader)
 		duration := time.Since(start)
+		unsubscribe()
+		for range events {
+			completionCount++
+		}
 
 		if err != nil {
 			t.Fatalf("StreamAndDetectCompletions failed: %v", err)
@@ -178,4 +184,79 @@ func TestToolCompletionCorrelator(t *testing.T) {
 			t.Errorf("Expected 0 pending tools after completion, got %d", len(pending))
 		}
 	})
+	t.Run("CompletionBeforeRegistration", func(t *testing.T) {
+		correlator := NewToolsTracker(nil)
+		events, unsubscribe := correlator.Subscribe()
+		defer unsubscribe()
+
+		err := correlator.ProcessLine([]byte(`{"type":"user","message":{"role":"user","content":[{"tool_use_id":"toolu_early","type":"tool_result","content":"Result"}]},"timestamp":"2025-06-03T21:48:07.681Z"}`), 1)
+		if err != nil {
+			t.Fatalf("ProcessLine failed: %v", err)
+		}
+		if len(events) != 0 {
+			t.Fatalf("Expected no event before the tool is expected, got %d", len(events))
+		}
+
+		correlator.AddPendingTool("toolu_early")
+		if len(correlator.GetPendingTools()) != 0 {
+			t.Errorf("Tool completed before registration should not be pending")
+		}
+		if ev := <-events; ev.ToolID != "toolu_early" || ev.LineNo != 1 {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	})
+
+	t.Run("CompletionsWithoutSubscriberDoNotBlock", func(t *testing.T) {
+		correlator := NewToolsTracker(nil)
+		// Subscribed but never reading.
+		_, unsubscribe := correlator.Subscribe()
+		defer unsubscribe()
+		for i := 0; i < subscriberBuffer+2; i++ {
+			id := fmt.Sprintf("toolu_%d", i)
+			correlator.AddPendingTool(id)
+			correlator.markToolCompleted(id)
+		}
+		if err := correlator.Wait(context.Background()); err != nil {
+			t.Errorf("Wait failed: %v", err)
+		}
+	})
+
+	t.Run("DeliveredCompletionsAreForgotten", func(t *testing.T) {
+		correlator := NewToolsTracker(nil)
+		correlator.AddPendingTool("toolu_a")
+		correlator.markToolCompleted("toolu_a")
+		correlator.markToolCompleted("toolu_b")
+		correlator.AddPendingTool("toolu_b")
+		// Logged long ago and never expected.
+		correlator.complete(ToolCompletionEvent{ToolID: "toolu_old", Timestamp: time.Now().Add(-2 * unexpectedTTL)})
+		correlator.markToolCompleted("toolu_c")
+		if len(correlator.expected) != 0 {
+			t.Errorf("Expected no expected tools left, got %v", correlator.expected)
+		}
+		if _, ok := correlator.completed["toolu_c"]; len(correlator.completed) != 1 || !ok {
+			t.Errorf("Expected only toolu_c to be kept, got %v", correlator.completed)
+		}
+	})
+
+	t.Run("Wait", func(t *testing.T) {
+		correlator := NewToolsTracker(map[string]struct{}{"toolu_wait": {}})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := correlator.Wait(ctx); err != context.DeadlineExceeded {
+			t.Fatalf("Expected Wait to time out, got %v", err)
+		}
+
+		done := make(chan error)
+		go func() { done <- correlator.Wait(context.Background()) }()
+		correlator.markToolCompleted("toolu_wait")
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Wait failed: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Wait did not return after the tool completed")
+		}
+	})
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sandbox are the resource limits and hardening options of the container.
+type sandbox struct {
+	CPUs      string // fraction of the host CPUs, no limit if empty
+	Memory    string // with a unit suffix, no limit if empty
+	PidsLimit int    // no limit if 0
+	// ReadOnly makes the root filesystem read-only. The workdir and the agent's home
+	// are volumes, /tmp and /run are tmpfs: none of them end up in docker snapshots.
+	ReadOnly        bool
+	CapDrop         []string // dropping ALL keeps the capabilities the proxy needs
+	Seccomp         string   // seccomp profile, docker's default if empty
+	NoNewPrivileges bool
+}
+
+// proxyCaps are the capabilities the startup and the proxy need as root: giving
+// the copied workdir to the agent, whatever its permissions, and dropping to the
+// agent's user. The firewall's NET_ADMIN is added separately.
+var proxyCaps = []string{"CHOWN", "DAC_OVERRIDE", "FOWNER", "SETUID", "SETGID"}
+
+// dockerArgs returns the docker run arguments applying s, quoted for a shell. With
+// a read-only root filesystem, workdir becomes a volume unless it is empty.
+func (s sandbox) dockerArgs(workdir string) []string {
+	var args []string
+	if s.CPUs != "" {
+		args = append(args, "--cpus", fmt.Sprintf("%q", s.CPUs))
+	}
+	if s.Memory != "" {
+		// Without swap on top of it.
+		args = append(args, "--memory", fmt.Sprintf("%q", s.Memory), "--memory-swap", fmt.Sprintf("%q", s.Memory))
+	}
+	if s.PidsLimit > 0 {
+		args = append(args, "--pids-limit", fmt.Sprint(s.PidsLimit))
+	}
+	if s.ReadOnly {
+		args = append(args, "--read-only", "--tmpfs", "/tmp:exec,size=1g", "--tmpfs", "/run", "-v", "/home/cosmos")
+		if workdir != "" {
+			args = append(args, "-v", fmt.Sprintf("%q", workdir))
+		}
+	}
+	for _, c := range s.CapDrop {
+		args = append(args, "--cap-drop", fmt.Sprintf("%q", c))
+	}
+	if slices.ContainsFunc(s.CapDrop, func(c string) bool { return strings.EqualFold(c, "ALL") }) {
+		for _, c := range proxyCaps {
+			args = append(args, "--cap-add", c)
+		}
+	}
+	if s.Seccomp != "" {
+		args = append(args, "--security-opt", fmt.Sprintf("%q", "seccomp="+s.Seccomp))
+	}
+	if s.NoNewPrivileges {
+		args = append(args, "--security-opt", "no-new-privileges")
+	}
+	return args
+}
+
+// appliedSandbox is what docker made of the sandbox options of a container.
+type appliedSandbox struct {
+	NanoCpus       int64
+	Memory         int64
+	MemorySwap     int64
+	PidsLimit      *int64
+	ReadonlyRootfs bool
+	CapAdd         []string
+	CapDrop        []string
+	SecurityOpt    []string
+	Tmpfs          map[string]string
+}
+
+// inspectSandbox returns the limits docker applied to container.
+func inspectSandbox(ctx context.Context, container string) (*appliedSandbox, error) {
+	out, err := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{json .HostConfig}}", container).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker inspect: %w", err)
+	}
+	var a appliedSandbox
+	if err := json.Unmarshal(out, &a); err != nil {
+		return nil, err
+	}
+	// The seccomp profile is inlined, its name was logged with the options.
+	for i, o := range a.SecurityOpt {
+		if strings.HasPrefix(o, "seccomp=") && len(o) > 100 {
+			a.SecurityOpt[i] = "seccomp=<profile>"
+		}
+	}
+	return &a, nil
+}
+
+// throwawayRun returns the shell command running the command given as "$1" with
+// sh in a throwaway container of img, in wd, as the agent's user and under the
+// sandbox options of the sessions. Outside of the full network mode the container
+// has no network, there is no proxy in it to apply the rules. The command is
+// stopped after timeout, docker would leave the container running if the client
+// was killed instead.
+func throwawayRun(img, wd string, timeout time.Duration) string {
+	args := []string{"exec docker run --rm --entrypoint timeout -u cosmos -w", fmt.Sprintf("%q", wd)}
+	if opts.Network != "full" {
+		args = append(args, "--network", "none")
+	}
+	args = append(args, opts.Sandbox.dockerArgs("")...)
+	args = append(args, fmt.Sprintf("%q", img))
+	return strings.Join(append(args, timeoutArgs(timeout)...), " ") + ` sh -c "$1"`
+}
+
+// timeoutArgs are the arguments of timeout stopping a command after d, killing it
+// if it doesn't stop.
+func timeoutArgs(d time.Duration) []string {
+	return []string{"-k", "10s", fmt.Sprintf("%ds", int(d.Seconds()))}
+}
+
+// timedOut reports whether timeout stopped the command it ran.
+func timedOut(exitCode int) bool {
+	return exitCode == 124 || exitCode == 137
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/tiborvass/cosmos/ignore"
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// seedFiles lists the files and directories of root to copy into the container,
+// leaving out those ignored by the .gitignore files and .cosmosignore, and returns
+// the total size of the files.
+func seedFiles(root string) (paths []string, files int, size int64, err error) {
+	var m ignore.Matcher
+	if err := m.AddGitignore(filepath.Join(root, ".git", "info", "exclude"), ""); err != nil {
+		return nil, 0, 0, err
+	}
+	if err := m.AddCosmosignore(filepath.Join(root, ".cosmosignore")); err != nil {
+		return nil, 0, 0, err
+	}
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return m.AddGitignore(filepath.Join(path, ".gitignore"), "")
+		}
+		if m.Ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		paths = append(paths, rel)
+		if d.IsDir() {
+			return m.AddGitignore(filepath.Join(path, ".gitignore"), rel)
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return paths, files, size, err
+}
+
+// seedWorkdir streams the files at paths under root into the same directory of the container.
+func seedWorkdir(ctx context.Context, container, root string, paths []string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(workdir.WriteTar(pw, root, paths))
+	}()
+	cmd := exec.CommandContext(ctx, "docker", "cp", "-", container+":"+root)
+	cmd.Stdin = pr
+	out, err := cmd.CombinedOutput()
+	pr.Close()
+	if err != nil {
+		return fmt.Errorf("docker cp: %w: %s", err, out)
+	}
+	return nil
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// sessionsDir holds a directory per session with its info, the host log, its
+// events and the logs of its container.
+var sessionsDir = filepath.Join(cosmosDir, "sessions")
+
+func sessionDir(id string) string { return filepath.Join(sessionsDir, id) }
+
+// containerName is the name of the container of a session, which a load removes
+// before running the next one.
+func containerName(id string) string { return "cosmos-" + id }
+
+// sessionInfo is what the commands know of a session, saved to session.json in
+// its directory when it starts.
+type sessionInfo struct {
+	ID      string
+	Workdir string
+	Mount   string
+	Backend string
+	GitBase string `json:",omitempty"`
+	Started time.Time
+	// Sandbox is what docker resolved the sandbox options to for the last container.
+	Sandbox *appliedSandbox `json:",omitempty"`
+}
+
+// saveSessionInfo records the session, unless a reexec already did.
+func saveSessionInfo(sess *session) error {
+	name := filepath.Join(sessionDir(sess.ID), "session.json")
+	if fileExists(name) {
+		return nil
+	}
+	b, err := json.MarshalIndent(sessionInfo{ID: sess.ID, Workdir: sess.Workdir, Mount: opts.Mount, Backend: opts.SnapshotBackend, GitBase: sess.GitBase, Started: time.Now()}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0644)
+}
+
+// recordSandbox adds the limits docker applied to the container of the session to
+// its session.json.
+func recordSandbox(sess *session, applied *appliedSandbox) error {
+	name := filepath.Join(sessionDir(sess.ID), "session.json")
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var info sessionInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return err
+	}
+	info.Sandbox = applied
+	if b, err = json.MarshalIndent(info, "", "\t"); err != nil {
+		return err
+	}
+	return os.WriteFile(name, b, 0644)
+}
+
+// loadSessions returns the recorded sessions, oldest first.
+func loadSessions() ([]*sessionInfo, error) {
+	entries, err := os.ReadDir(sessionsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sessions []*sessionInfo
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(sessionsDir, e.Name(), "session.json"))
+		if err != nil {
+			continue
+		}
+		info := &sessionInfo{}
+		if err := json.Unmarshal(b, info); err != nil {
+			return nil, fmt.Errorf("session %s: %w", e.Name(), err)
+		}
+		sessions = append(sessions, info)
+	}
+	slices.SortFunc(sessions, func(a, b *sessionInfo) int { return a.Started.Compare(b.Started) })
+	return sessions, nil
+}
+
+// findSession returns the session whose ID is or starts with id.
+func findSession(id string) (*sessionInfo, error) {
+	sessions, err := loadSessions()
+	if err != nil {
+		return nil, err
+	}
+	var found *sessionInfo
+	for _, s := range sessions {
+		if s.ID == id {
+			return s, nil
+		}
+		if strings.HasPrefix(s.ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("session %q is ambiguous: %s, %s", id, found.ID, s.ID)
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no session %q", id)
+	}
+	return found, nil
+}
+
+// sessionArg returns the session named by the only argument of a command.
+func sessionArg(fs *flag.FlagSet) *sessionInfo {
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	info, err := findSession(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return info
+}
+
+// containerStates returns the status of the session containers, by session ID.
+func containerStates(ctx context.Context) (map[string]string, error) {
+	out, err := exec.CommandContext(ctx, "docker", "ps", "-a", "--filter", "label=cosmos.session", "--format", "{{.Label \"cosmos.session\"}}\t{{.Status}}").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("docker ps: %w: %s", err, out)
+	}
+	states := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if id, status, ok := strings.Cut(line, "\t"); ok {
+			states[id] = status
+		}
+	}
+	return states, nil
+}
+
+// cmdPs lists the sessions whose container runs, or all of them.
+func cmdPs(args []string) {
+	fs := flag.NewFlagSet("ps", flag.ExitOnError)
+	all := fs.Bool("a", false, "show the sessions whose container stopped or was removed too")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	sessions := M2(loadSessions())
+	states := M2(containerStates(ctx))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tSTARTED\tSTATUS\tSNAPSHOTS\tPROJECT")
+	st := M2(loadState())
+	for _, s := range sessions {
+		status, ok := states[s.ID]
+		if !ok {
+			status = "Removed"
+		}
+		if !*all && !strings.HasPrefix(status, "Up") {
+			continue
+		}
+		_, snaps, _ := st.Project(s.Workdir).Session(s.ID)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", s.ID, s.Started.Local().Format(time.DateTime), status, len(snaps), s.Workdir)
+	}
+	tw.Flush()
+}
+
+// cmdLogs shows the host log of a session, or the log of its proxy.
+func cmdLogs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos logs [-f] [--proxy] <session>")
+		fs.PrintDefaults()
+	}
+	follow := fs.Bool("f", false, "keep showing what is appended to the log")
+	proxy := fs.Bool("proxy", false, "show the log of the proxy in the container instead of the host's")
+	fs.Parse(args)
+	info := sessionArg(fs)
+
+	name := filepath.Join(sessionDir(info.ID), "cosmos.log")
+	if *proxy {
+		name = filepath.Join(sessionDir(info.ID), "proxy.log")
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	for {
+		M2(io.Copy(os.Stdout, f))
+		if !*follow {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// cmdAttach attaches the terminal to the agent of a running session.
+func cmdAttach(args []string) {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos attach <session>")
+		fmt.Fprintln(os.Stderr, "Ctrl-P Ctrl-Q detaches without stopping the agent. Approvals are still asked in the terminal that started the session.")
+	}
+	fs.Parse(args)
+	info := sessionArg(fs)
+
+	cmd := exec.Command("docker", "attach", containerName(info.ID))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "docker attach:", err)
+		os.Exit(1)
+	}
+}
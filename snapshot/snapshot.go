@@ -0,0 +1,241 @@
+// Package snapshot models the snapshots taken during agent sessions as a tree.
+//
+// Every snapshot records its parent and the conversation point at which it was
+// taken, so going back in the conversation starts a new branch instead of
+// discarding the snapshots taken after that point.
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Snapshot struct {
+	ID        string
+	Image     string
+	Parent    string // ID of the snapshot this one was taken on top of, empty for the first of a session
+	Hash      string // conversation point at which the snapshot was taken
+	Message   string
+	SessionID string
+	Created   time.Time
+	Turn      *Turn `json:",omitempty"` // what the agent did since the previous snapshot
+	// WorkdirArchive is set when the workdir was bind-mounted, and the files changed
+	// since Parent archived next to the image.
+	WorkdirArchive bool `json:",omitempty"`
+	// Commit and Ref are the commit of the workdir in the host repository, and the
+	// ref keeping it, with the git backend. Image is empty then.
+	Commit string `json:",omitempty"`
+	Ref    string `json:",omitempty"`
+	// Manifest and ClaudeManifest are the digests of the manifests of the workdir and
+	// of claude's sessions in the content-addressed store, with the store backend.
+	// Image is empty then.
+	Manifest       string `json:",omitempty"`
+	ClaudeManifest string `json:",omitempty"`
+	// Base is the commit of the workdir in the host repository when the session
+	// started, uncommitted changes included, if any. Exports diff against it.
+	Base string `json:",omitempty"`
+	// Tags are names given to the snapshot, unique in the tree, which protect it
+	// and its ancestors from gc.
+	Tags []string `json:",omitempty"`
+	// Verify is the result of the verification command run after the snapshot, if any.
+	Verify *Verification `json:",omitempty"`
+}
+
+// Tree holds the snapshots of a project in the order they were taken.
+type Tree struct {
+	Snapshots []*Snapshot
+}
+
+// Add appends s to the tree.
+func (t *Tree) Add(s *Snapshot) {
+	t.Snapshots = append(t.Snapshots, s)
+}
+
+// Get returns the snapshot with the given ID, or nil.
+func (t *Tree) Get(id string) *Snapshot {
+	for _, s := range t.Snapshots {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// Tagged returns the snapshot tagged name, or nil.
+func (t *Tree) Tagged(name string) *Snapshot {
+	for _, s := range t.Snapshots {
+		if slices.Contains(s.Tags, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Find returns the snapshot tagged id, or whose ID is or starts with id.
+func (t *Tree) Find(id string) (*Snapshot, error) {
+	if s := t.Tagged(id); s != nil {
+		return s, nil
+	}
+	var found *Snapshot
+	for _, s := range t.Snapshots {
+		if s.ID == id {
+			return s, nil
+		}
+		if strings.HasPrefix(s.ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("snapshot %q is ambiguous: %s, %s", id, Short(found.ID), Short(s.ID))
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no snapshot %q", id)
+	}
+	return found, nil
+}
+
+// Session returns the ID of the session that is or starts with id, and its
+// snapshots in the order they were taken.
+func (t *Tree) Session(id string) (string, []*Snapshot, error) {
+	found := ""
+	if slices.ContainsFunc(t.Snapshots, func(s *Snapshot) bool { return s.SessionID == id }) {
+		found = id
+	}
+	for _, s := range t.Snapshots {
+		if found == id || id == "" || !strings.HasPrefix(s.SessionID, id) || s.SessionID == found {
+			continue
+		}
+		if found != "" {
+			return "", nil, fmt.Errorf("session %q is ambiguous: %s, %s", id, found, s.SessionID)
+		}
+		found = s.SessionID
+	}
+	if found == "" {
+		return "", nil, fmt.Errorf("no session %q", id)
+	}
+	var snaps []*Snapshot
+	for _, s := range t.Snapshots {
+		if s.SessionID == found {
+			snaps = append(snaps, s)
+		}
+	}
+	return found, snaps, nil
+}
+
+// Children returns the snapshots taken on top of the snapshot id, oldest first.
+// An empty id returns the roots.
+func (t *Tree) Children(id string) []*Snapshot {
+	var children []*Snapshot
+	for _, s := range t.Snapshots {
+		if s.Parent == id {
+			children = append(children, s)
+		}
+	}
+	return children
+}
+
+// Ancestors returns the snapshot id followed by its parents up to the root.
+func (t *Tree) Ancestors(id string) []*Snapshot {
+	var out []*Snapshot
+	seen := map[string]bool{}
+	for s := t.Get(id); s != nil && !seen[s.ID]; s = t.Get(s.Parent) {
+		seen[s.ID] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// Drop removes the snapshot id from the tree, its children taking its parent.
+func (t *Tree) Drop(id string) {
+	s := t.Get(id)
+	if s == nil {
+		return
+	}
+	for _, c := range t.Children(id) {
+		c.Parent = s.Parent
+	}
+	t.Snapshots = slices.DeleteFunc(t.Snapshots, func(x *Snapshot) bool { return x == s })
+}
+
+// Prune removes the snapshots that are neither kept nor ancestors of kept ones,
+// and returns them.
+func (t *Tree) Prune(keep func(*Snapshot) bool) []*Snapshot {
+	kept := map[string]bool{}
+	for _, s := range t.Snapshots {
+		if keep(s) {
+			for _, a := range t.Ancestors(s.ID) {
+				kept[a.ID] = true
+			}
+		}
+	}
+	var removed []*Snapshot
+	t.Snapshots = slices.DeleteFunc(t.Snapshots, func(s *Snapshot) bool {
+		if !kept[s.ID] {
+			removed = append(removed, s)
+		}
+		return !kept[s.ID]
+	})
+	return removed
+}
+
+// RestorePoint returns the most recent snapshot among head and its ancestors that
+// was taken at one of the given conversation points, or nil if there is none.
+func (t *Tree) RestorePoint(head string, hashes []string) *Snapshot {
+	for _, s := range t.Ancestors(head) {
+		if s.Hash != "" && slices.Contains(hashes, s.Hash) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Graph writes the tree to w, one snapshot per line formatted by format.
+// Linear history stays in the same column, branches are drawn where they fork.
+func (t *Tree) Graph(w io.Writer, format func(*Snapshot) string) error {
+	var walk func(nodes []*Snapshot, prefix string) error
+	walk = func(nodes []*Snapshot, prefix string) error {
+		for {
+			switch len(nodes) {
+			case 0:
+				return nil
+			case 1:
+				if _, err := fmt.Fprintf(w, "%s%s\n", prefix, format(nodes[0])); err != nil {
+					return err
+				}
+				nodes = t.Children(nodes[0].ID)
+				continue
+			}
+			for i, n := range nodes {
+				branch, indent := "├── ", "│   "
+				if i == len(nodes)-1 {
+					branch, indent = "└── ", "    "
+				}
+				if _, err := fmt.Fprintf(w, "%s%s%s\n", prefix, branch, format(n)); err != nil {
+					return err
+				}
+				if err := walk(t.Children(n.ID), prefix+indent); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return walk(t.Children(""), "")
+}
+
+// Short returns the abbreviated form of a snapshot ID.
+func Short(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Summary returns the first line of the snapshot message.
+func (s *Snapshot) Summary() string {
+	line, _, _ := strings.Cut(s.Message, "\n")
+	return line
+}
@@ -0,0 +1,125 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+)
+
+func testTree() *Tree {
+	t := &Tree{}
+	t.Add(&Snapshot{ID: "a1", Hash: "h1", SessionID: "s1"})
+	t.Add(&Snapshot{ID: "a2", Parent: "a1", Hash: "h2", SessionID: "s1"})
+	t.Add(&Snapshot{ID: "a3", Parent: "a2", Hash: "h3", SessionID: "s1"})
+	// Rewound to a1 and continued differently.
+	t.Add(&Snapshot{ID: "b1", Parent: "a1", Hash: "h2b", SessionID: "s2"})
+	t.Add(&Snapshot{ID: "b2", Parent: "b1", Hash: "h3b", SessionID: "s2"})
+	return t
+}
+
+func TestRestorePoint(t *testing.T) {
+	tree := testTree()
+
+	if s := tree.RestorePoint("a3", []string{"h1", "h2"}); s == nil || s.ID != "a2" {
+		t.Errorf("expected a2, got %+v", s)
+	}
+	if s := tree.RestorePoint("a3", []string{"h1"}); s == nil || s.ID != "a1" {
+		t.Errorf("expected a1, got %+v", s)
+	}
+	// Snapshots of another branch are not restore points.
+	if s := tree.RestorePoint("b2", []string{"h1", "h2"}); s == nil || s.ID != "a1" {
+		t.Errorf("expected a1, got %+v", s)
+	}
+	if s := tree.RestorePoint("a3", nil); s != nil {
+		t.Errorf("expected no restore point, got %+v", s)
+	}
+	if s := tree.RestorePoint("", []string{"h1"}); s != nil {
+		t.Errorf("expected no restore point without head, got %+v", s)
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	tree := testTree()
+	var ids []string
+	for _, s := range tree.Ancestors("b2") {
+		ids = append(ids, s.ID)
+	}
+	if got := strings.Join(ids, " "); got != "b2 b1 a1" {
+		t.Errorf("unexpected ancestors %q", got)
+	}
+
+	// A cycle in corrupted state must not loop forever.
+	tree.Get("a1").Parent = "b2"
+	if n := len(tree.Ancestors("b2")); n != 3 {
+		t.Errorf("expected 3 ancestors, got %d", n)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	var sb strings.Builder
+	err := testTree().Graph(&sb, func(s *Snapshot) string { return s.ID })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `a1
+├── a2
+│   a3
+└── b1
+    b2
+`
+	if sb.String() != expected {
+		t.Errorf("unexpected graph:\n%s", sb.String())
+	}
+}
+
+func TestFind(t *testing.T) {
+	tree := testTree()
+	if s, err := tree.Find("b1"); err != nil || s.ID != "b1" {
+		t.Errorf("expected b1, got %+v, %v", s, err)
+	}
+	if s, err := tree.Find("a"); err == nil {
+		t.Errorf("expected a1, a2 and a3 to be ambiguous, got %+v", s)
+	}
+	if s, err := tree.Find("c"); err == nil {
+		t.Errorf("expected no snapshot, got %+v", s)
+	}
+	tree.Get("a2").Tags = []string{"a"}
+	if s, err := tree.Find("a"); err != nil || s.ID != "a2" {
+		t.Errorf("expected a2 tagged a, got %+v, %v", s, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tree := testTree()
+	removed := tree.Prune(func(s *Snapshot) bool { return s.ID == "b1" })
+	var ids []string
+	for _, s := range removed {
+		ids = append(ids, s.ID)
+	}
+	if strings.Join(ids, " ") != "a2 a3 b2" {
+		t.Errorf("expected a2, a3 and b2 to be removed, got %v", ids)
+	}
+	if len(tree.Snapshots) != 2 || tree.Get("a1") == nil || tree.Get("b1") == nil {
+		t.Errorf("expected a1 and b1 to be kept, got %+v", tree.Snapshots)
+	}
+}
+
+func TestSession(t *testing.T) {
+	tree := testTree()
+	if id, snaps, err := tree.Session("s2"); err != nil || id != "s2" || len(snaps) != 2 || snaps[1].ID != "b2" {
+		t.Errorf("expected b1 and b2 of s2, got %q %+v, %v", id, snaps, err)
+	}
+	if _, _, err := tree.Session("s"); err == nil {
+		t.Errorf("expected s1 and s2 to be ambiguous")
+	}
+	if _, _, err := tree.Session("s3"); err == nil {
+		t.Errorf("expected no session")
+	}
+}
+
+func TestDrop(t *testing.T) {
+	tree := testTree()
+	tree.Drop("a1")
+	if tree.Get("a1") != nil || tree.Get("a2").Parent != "" || tree.Get("b1").Parent != "" {
+		t.Errorf("expected a2 and b1 to become roots, got %+v %+v", tree.Get("a2"), tree.Get("b1"))
+	}
+}
@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Turn summarizes the agent turn that led to a snapshot.
+type Turn struct {
+	Prompt string
+	Tools  []ToolCall
+	Text   string // excerpt of the final assistant text
+	Usage  Usage
+}
+
+// ToolCall is a tool the agent used and its most telling input.
+type ToolCall struct {
+	Name  string
+	Input string
+}
+
+// Usage is the number of tokens spent by the API requests of a turn.
+type Usage struct {
+	InputTokens              int64
+	OutputTokens             int64
+	CacheReadInputTokens     int64
+	CacheCreationInputTokens int64
+}
+
+func (u *Usage) Add(o Usage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("%d in, %d out, %d cache read, %d cache write", u.InputTokens, u.OutputTokens, u.CacheReadInputTokens, u.CacheCreationInputTokens)
+}
+
+// keyInputs are the tool input fields that best describe a tool call, in order of preference.
+var keyInputs = []string{"file_path", "notebook_path", "path", "command", "pattern", "url", "query", "description", "prompt"}
+
+// NewToolCall describes the call of tool name with the JSON input.
+func NewToolCall(name string, input json.RawMessage) ToolCall {
+	var fields map[string]any
+	json.Unmarshal(input, &fields)
+	for _, k := range keyInputs {
+		if s, ok := fields[k].(string); ok && s != "" {
+			return ToolCall{Name: name, Input: Excerpt(s, 100)}
+		}
+	}
+	return ToolCall{Name: name}
+}
+
+func (c ToolCall) String() string {
+	if c.Input == "" {
+		return c.Name
+	}
+	return c.Name + ": " + c.Input
+}
+
+// Message returns the snapshot message: a title line from the prompt followed by the details of the turn.
+func (t *Turn) Message() string {
+	var sb strings.Builder
+	title := Excerpt(t.Prompt, 72)
+	if title == "" {
+		title = "(no prompt)"
+	}
+	sb.WriteString(title + "\n")
+	if t.Prompt != "" {
+		fmt.Fprintf(&sb, "\nPrompt: %s\n", Excerpt(t.Prompt, 1000))
+	}
+	if len(t.Tools) > 0 {
+		sb.WriteString("\nTools:\n")
+		for _, c := range t.Tools {
+			fmt.Fprintf(&sb, "  %s\n", c)
+		}
+	}
+	if t.Text != "" {
+		fmt.Fprintf(&sb, "\nResponse: %s\n", t.Text)
+	}
+	fmt.Fprintf(&sb, "\nTokens: %s\n", t.Usage)
+	return sb.String()
+}
+
+// Labels returns the image labels describing the turn.
+func (t *Turn) Labels() map[string]string {
+	var names []string
+	seen := map[string]bool{}
+	for _, c := range t.Tools {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			names = append(names, c.Name)
+		}
+	}
+	return map[string]string{
+		"cosmos.prompt":        Excerpt(t.Prompt, 200),
+		"cosmos.tools":         strings.Join(names, ","),
+		"cosmos.tool_calls":    strconv.Itoa(len(t.Tools)),
+		"cosmos.tokens.input":  strconv.FormatInt(t.Usage.InputTokens+t.Usage.CacheReadInputTokens+t.Usage.CacheCreationInputTokens, 10),
+		"cosmos.tokens.output": strconv.FormatInt(t.Usage.OutputTokens, 10),
+	}
+}
+
+// Excerpt returns s on a single line, cut to n runes.
+func Excerpt(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,63 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTurn(t *testing.T) {
+	turn := &Turn{
+		Prompt: "Fix the flaky test\nin proxy",
+		Tools: []ToolCall{
+			NewToolCall("Read", json.RawMessage(`{"file_path":"/w/proxy/proxy.go","limit":10}`)),
+			NewToolCall("Bash", json.RawMessage(`{"command":"go test ./...","description":"Run tests"}`)),
+			NewToolCall("TodoWrite", json.RawMessage(`{"todos":[]}`)),
+			NewToolCall("Read", json.RawMessage(`{"file_path":"/w/main.go"}`)),
+		},
+		Text:  "Fixed.",
+		Usage: Usage{InputTokens: 10, OutputTokens: 20, CacheReadInputTokens: 30},
+	}
+
+	msg := turn.Message()
+	title, _, _ := strings.Cut(msg, "\n")
+	if title != "Fix the flaky test in proxy" {
+		t.Errorf("unexpected title %q", title)
+	}
+	for _, s := range []string{"  Read: /w/proxy/proxy.go\n", "  Bash: go test ./...\n", "  TodoWrite\n", "Response: Fixed.\n", "Tokens: 10 in, 20 out, 30 cache read, 0 cache write\n"} {
+		if !strings.Contains(msg, s) {
+			t.Errorf("expected message to contain %q, got:\n%s", s, msg)
+		}
+	}
+
+	labels := turn.Labels()
+	if labels["cosmos.tools"] != "Read,Bash,TodoWrite" || labels["cosmos.tool_calls"] != "4" || labels["cosmos.tokens.input"] != "40" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+}
+
+func TestExcerpt(t *testing.T) {
+	if s := Excerpt("héllo   wörld", 8); s != "héllo w…" {
+		t.Errorf("unexpected excerpt %q", s)
+	}
+	if s := Excerpt("short", 8); s != "short" {
+		t.Errorf("unexpected excerpt %q", s)
+	}
+}
+
+func TestTail(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"ok\n", 10, "ok"},
+		{"a\nbb\nccc\n", 7, "bb\nccc"},
+		{"a\nbb\nccc", 5, "ccc"},
+		{"abcdef", 3, "def"},
+	} {
+		if got := Tail(tc.s, tc.n); got != tc.want {
+			t.Errorf("Tail(%q, %d) = %q, want %q", tc.s, tc.n, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Verification is the result of the verification command run in the container
+// after the snapshot of the end of a turn.
+type Verification struct {
+	Command  string
+	ExitCode int    // -1 if the command timed out
+	Output   string // the end of its output
+	Duration time.Duration
+}
+
+// Passed tells whether the command succeeded.
+func (v *Verification) Passed() bool { return v.ExitCode == 0 }
+
+func (v *Verification) String() string {
+	switch {
+	case v.Passed():
+		return "passed"
+	case v.ExitCode < 0:
+		return "timed out"
+	default:
+		return fmt.Sprintf("failed (%d)", v.ExitCode)
+	}
+}
+
+// Tail returns the last lines of s that fit in n bytes, or its last n bytes if
+// its last line doesn't fit.
+func Tail(s string, n int) string {
+	s = strings.TrimRight(s, "\n")
+	if len(s) <= n {
+		return s
+	}
+	s = s[len(s)-n:]
+	if i := strings.IndexByte(s, '\n'); i >= 0 && i < len(s)-1 {
+		return s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// cmdSquash flattens the snapshot images of a session of the project in the
+// current directory into single-layer images.
+func cmdSquash(args []string) {
+	fs := flag.NewFlagSet("squash", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos squash [--all] <session>")
+		fs.PrintDefaults()
+	}
+	all := fs.Bool("all", false, "squash every snapshot of the session, not only the latest")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	workdir := M2(os.Getwd())
+	id, snaps, err := M2(loadState()).Project(workdir).Session(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	snaps = slices.DeleteFunc(snaps, func(s *snapshot.Snapshot) bool { return s.Image == "" })
+	if len(snaps) == 0 {
+		fmt.Fprintln(os.Stderr, "session", id, "has no snapshot images")
+		os.Exit(1)
+	}
+	if !*all {
+		snaps = snaps[len(snaps)-1:]
+	}
+	for _, s := range snaps {
+		layers, err := imageLayers(ctx, s.Image)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, snapshot.Short(s.ID)+":", err)
+			os.Exit(1)
+		}
+		if layers <= 1 {
+			continue
+		}
+		image, err := squashImage(ctx, s.Image, "cosmos:"+s.ID, s.Message)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, snapshot.Short(s.ID)+":", err)
+			os.Exit(1)
+		}
+		M(updateState(func(st *State) error {
+			if snap := st.Project(workdir).Get(s.ID); snap != nil {
+				snap.Image = image
+			}
+			return nil
+		}))
+		fmt.Printf("%s %d layers squashed into %s\n", snapshot.Short(s.ID), layers, image)
+	}
+}
+
+// imageLayers returns the number of layers of image.
+func imageLayers(ctx context.Context, image string) (int, error) {
+	out, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format", "{{len .RootFS.Layers}}", image).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("docker image inspect: %w: %s", err, out)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// squashImage flattens image into a single-layer image with the same
+// configuration, tagged tag, and returns its ID. The layers of image are left to
+// the images that still share them.
+func squashImage(ctx context.Context, image, tag, message string) (string, error) {
+	out, err := exec.CommandContext(ctx, "docker", "image", "inspect", "--format", "{{json .Config}}", image).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker image inspect: %w: %s", err, out)
+	}
+	var config struct {
+		User         string
+		WorkingDir   string
+		Env          []string
+		Entrypoint   []string
+		Cmd          []string
+		Labels       map[string]string
+		ExposedPorts map[string]struct{}
+	}
+	if err := json.Unmarshal(out, &config); err != nil {
+		return "", err
+	}
+	// docker import only takes the configuration as Dockerfile instructions.
+	var changes []string
+	if config.User != "" {
+		changes = append(changes, "USER "+config.User)
+	}
+	if config.WorkingDir != "" {
+		changes = append(changes, "WORKDIR "+config.WorkingDir)
+	}
+	for _, env := range config.Env {
+		k, v, _ := strings.Cut(env, "=")
+		changes = append(changes, fmt.Sprintf("ENV %s=%s", k, strconv.Quote(v)))
+	}
+	if config.Entrypoint != nil {
+		changes = append(changes, "ENTRYPOINT "+string(M2(json.Marshal(config.Entrypoint))))
+	}
+	if config.Cmd != nil {
+		changes = append(changes, "CMD "+string(M2(json.Marshal(config.Cmd))))
+	}
+	for _, k := range slices.Sorted(maps.Keys(config.Labels)) {
+		changes = append(changes, fmt.Sprintf("LABEL %s=%s", k, strconv.Quote(config.Labels[k])))
+	}
+	for _, port := range slices.Sorted(maps.Keys(config.ExposedPorts)) {
+		changes = append(changes, "EXPOSE "+port)
+	}
+
+	out, err = exec.CommandContext(ctx, "docker", "create", image).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker create: %w: %s", err, out)
+	}
+	container := strings.TrimSpace(string(out))
+	defer exec.Command("docker", "rm", "-f", container).Run()
+
+	export := exec.CommandContext(ctx, "docker", "export", container)
+	importArgs := []string{"import", "-m", message}
+	for _, c := range changes {
+		importArgs = append(importArgs, "-c", c)
+	}
+	imp := exec.CommandContext(ctx, "docker", append(importArgs, "-", tag)...)
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	var exportErr, importOut, importErr strings.Builder
+	export.Stdout, export.Stderr = w, &exportErr
+	imp.Stdin, imp.Stdout, imp.Stderr = r, &importOut, &importErr
+	err = export.Start()
+	if err == nil {
+		if err = imp.Start(); err != nil {
+			export.Process.Kill()
+			export.Wait()
+		}
+	}
+	// Only the commands have the pipe now, export stops if import does.
+	r.Close()
+	w.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := errors.Join(imp.Wait(), export.Wait()); err != nil {
+		return "", fmt.Errorf("docker export | docker import: %w: %s%s", err, exportErr.String(), importErr.String())
+	}
+	return strings.TrimSpace(importOut.String()), nil
+}
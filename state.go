@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	. "github.com/tiborvass/cosmos/utils"
+	"golang.org/x/sys/unix"
+)
+
+var cosmosDir = filepath.Join(M2(os.UserConfigDir()), ".cosmos")
+
+// State is what cosmos remembers across runs, stored in state.json.
+type State struct {
+	Projects map[string]*snapshot.Tree
+}
+
+// Project returns the snapshot tree of the project in workdir.
+func (st *State) Project(workdir string) *snapshot.Tree {
+	if st.Projects == nil {
+		st.Projects = map[string]*snapshot.Tree{}
+	}
+	t, ok := st.Projects[workdir]
+	if !ok {
+		t = &snapshot.Tree{}
+		st.Projects[workdir] = t
+	}
+	return t
+}
+
+func loadState() (*State, error) {
+	st := &State{}
+	f, err := os.Open(filepath.Join(cosmosDir, "state.json"))
+	if os.IsNotExist(err) {
+		return st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return st, json.NewDecoder(f).Decode(st)
+}
+
+// updateState loads the state, lets fn modify it and saves it. Several cosmos
+// processes may run at once, the state file is locked for the whole update.
+func updateState(fn func(*State) error) error {
+	if err := os.MkdirAll(cosmosDir, 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(filepath.Join(cosmosDir, "state.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX); err != nil {
+		return err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	st, err := loadState()
+	if err != nil {
+		return err
+	}
+	if err := fn(st); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(cosmosDir, "state.json.tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(cosmosDir, "state.json"))
+}
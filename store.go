@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/store"
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// backendStore records the workdir and claude's sessions in the content-addressed store.
+const backendStore = "store"
+
+// storeDir holds the blobs and manifests of the store backend.
+var storeDir = filepath.Join(cosmosDir, "store")
+
+// storeSnapshot records the workdir and claude's sessions in the container, the
+// files unchanged since prev without hashing them again, and returns the digests
+// of their manifests.
+func storeSnapshot(ctx context.Context, s *store.Store, container, workdir string, prev *snapshot.Snapshot) (manifest, claude string, err error) {
+	var prevManifest, prevClaude string
+	if prev != nil {
+		prevManifest, prevClaude = prev.Manifest, prev.ClaudeManifest
+	}
+	if manifest, err = storeDirectory(ctx, s, container, workdir, prevManifest); err != nil {
+		return "", "", err
+	}
+	if claude, err = storeDirectory(ctx, s, container, claudeProjects, prevClaude); err != nil {
+		return "", "", fmt.Errorf("storing claude's sessions: %w", err)
+	}
+	return manifest, claude, nil
+}
+
+// storeDirectory records the directory dir of the container on top of the manifest
+// prev, if any, and returns the digest of its manifest.
+func storeDirectory(ctx context.Context, s *store.Store, container, dir, prev string) (string, error) {
+	var old workdir.Manifest
+	if prev != "" {
+		var err error
+		if old, err = s.Manifest(prev); err != nil {
+			fmt.Fprintln(logFile, "previous manifest:", err)
+		}
+	}
+	cmd := exec.CommandContext(ctx, "docker", "exec", container, "tar", "-C", dir, "-cf", "-", ".")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	m, err := s.ReadTar(out, old)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return "", err
+	}
+	if err := cmd.Wait(); err != nil {
+		return "", fmt.Errorf("docker exec tar: %w: %s", err, stderr.String())
+	}
+	changed := 0
+	for p, e := range m {
+		if o, ok := old[p]; !ok || o.Digest != e.Digest || o.Link != e.Link {
+			changed++
+		}
+	}
+	fmt.Fprintln(logFile, "Stored", dir, len(m), "files,", changed, "changed")
+	return s.PutManifest(m)
+}
+
+// restoreFromStore materializes the workdir and claude's sessions of snap in the
+// fresh container. The workdir files unchanged since the host copy are copied from
+// it, only the others are read from the store.
+func restoreFromStore(ctx context.Context, s *store.Store, container, workdir string, snap *snapshot.Snapshot) error {
+	if err := restoreDirectory(ctx, s, container, workdir, snap.Manifest, workdir); err != nil {
+		return err
+	}
+	if snap.ClaudeManifest == "" {
+		return nil
+	}
+	if err := restoreDirectory(ctx, s, container, claudeProjects, snap.ClaudeManifest, ""); err != nil {
+		return fmt.Errorf("restoring claude's sessions: %w", err)
+	}
+	return nil
+}
+
+// restoreDirectory writes the files of the manifest digest in the directory dir
+// of the container, taking those that local has as is from there.
+func restoreDirectory(ctx context.Context, s *store.Store, container, dir, digest, local string) error {
+	m, err := s.Manifest(digest)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.WriteTar(pw, m, local))
+	}()
+	err = copyToContainer(ctx, container, dir, pr)
+	pr.CloseWithError(err)
+	return err
+}
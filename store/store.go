@@ -0,0 +1,249 @@
+// Package store keeps the states of a directory as content-addressed blobs and
+// manifests, so that snapshots only add the files that changed and any state can
+// be rebuilt without going through the ones before it.
+//
+// A blob is stored once under the SHA-256 of its content, whatever the number
+// of files and snapshots that have it. A manifest is a workdir.Manifest with the
+// digest of the content of each file, and is itself stored as a blob.
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tiborvass/cosmos/workdir"
+)
+
+// Store is a directory of blobs.
+type Store struct {
+	dir string
+}
+
+// Open returns the store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(digest string) (string, error) {
+	hex, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hex) != 2*sha256.Size {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(s.dir, "blobs", "sha256", hex[:2], hex[2:]), nil
+}
+
+// Has reports whether the store has the blob digest.
+func (s *Store) Has(digest string) bool {
+	name, err := s.path(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(name)
+	return err == nil
+}
+
+// Put stores the content read from r, unless the store already has it, and
+// returns its digest.
+func (s *Store) Put(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if err := errors.Join(err, tmp.Close()); err != nil {
+		return "", err
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	name, _ := s.path(digest)
+	if s.touch(digest) {
+		return digest, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(tmp.Name(), name)
+}
+
+// touch marks the blob digest as used now, so that Sweep leaves it alone for a
+// while, and reports whether the store has it.
+func (s *Store) touch(digest string) bool {
+	name, err := s.path(digest)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	return os.Chtimes(name, now, now) == nil
+}
+
+// Get opens the blob digest.
+func (s *Store) Get(digest string) (*os.File, error) {
+	name, err := s.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(name)
+}
+
+// PutManifest stores m and returns its digest.
+func (s *Store) PutManifest(m workdir.Manifest) (string, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return s.Put(bytes.NewReader(b))
+}
+
+// Manifest returns the manifest digest.
+func (s *Store) Manifest(digest string) (workdir.Manifest, error) {
+	f, err := s.Get(digest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var m workdir.Manifest
+	return m, json.NewDecoder(f).Decode(&m)
+}
+
+// ReadTar stores the files of the tar read from r and returns their manifest.
+// The files that have the same size, modification time and mode as in prev are
+// taken to be unchanged and not hashed again.
+func (s *Store) ReadTar(r io.Reader, prev workdir.Manifest) (workdir.Manifest, error) {
+	m := workdir.Manifest{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return m, nil
+		} else if err != nil {
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("archive entry %q is outside of the directory", hdr.Name)
+		}
+		e, ok := workdir.HeaderState(hdr)
+		if !ok {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if old, ok := prev[name]; ok && old.Same(e) && s.touch(old.Digest) {
+				e.Digest = old.Digest
+			} else if e.Digest, err = s.Put(tr); err != nil {
+				return nil, err
+			}
+		}
+		m[name] = e
+	}
+}
+
+// WriteTar writes the files of m to w as a tar. A file under local with the
+// size, modification time and mode of its entry is taken from there, the others
+// from their blob, so that local can stand for an earlier state of the directory
+// and only the files changed since then are read from the store. An empty local
+// takes every file from the store.
+func (s *Store) WriteTar(w io.Writer, m workdir.Manifest, local string) error {
+	tw := tar.NewWriter(w)
+	for _, p := range slices.Sorted(maps.Keys(m)) {
+		if err := s.addFile(tw, p, m[p], local); err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	return tw.Close()
+}
+
+func (s *Store) addFile(tw *tar.Writer, p string, e workdir.FileState, local string) error {
+	hdr := &tar.Header{Name: p, Mode: int64(e.Mode.Perm()), ModTime: e.ModTime, Format: tar.FormatPAX}
+	if e.Link != "" {
+		hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.Link
+		return tw.WriteHeader(hdr)
+	}
+	hdr.Typeflag, hdr.Size = tar.TypeReg, e.Size
+	var f *os.File
+	if local != "" {
+		name := filepath.Join(local, filepath.FromSlash(p))
+		if info, err := os.Lstat(name); err == nil && e.Same(workdir.InfoState(info)) {
+			f, _ = os.Open(name)
+		}
+	}
+	if f == nil {
+		var err error
+		if f, err = s.Get(e.Digest); err != nil {
+			return err
+		}
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, f, e.Size)
+	return err
+}
+
+// Sweep removes the blobs that are neither one of the manifests nor the content
+// of one of their files, and returns how many it removed and their size. Blobs
+// used in the last grace are kept, snapshots being taken may need them.
+func (s *Store) Sweep(manifests []string, grace time.Duration) (removed int, size int64, err error) {
+	used := map[string]bool{}
+	for _, d := range manifests {
+		m, err := s.Manifest(d)
+		if err != nil {
+			return 0, 0, fmt.Errorf("manifest %s: %w", d, err)
+		}
+		used[d] = true
+		for _, e := range m {
+			used[e.Digest] = true
+		}
+	}
+	root := filepath.Join(s.dir, "blobs", "sha256")
+	cutoff := time.Now().Add(-grace)
+	err = filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && name == root {
+			return filepath.SkipAll
+		} else if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if used["sha256:"+strings.ReplaceAll(filepath.ToSlash(rel), "/", "")] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		removed++
+		size += info.Size()
+		return nil
+	})
+	return removed, size, err
+}
@@ -0,0 +1,143 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type file struct {
+	name, content string
+	mtime         time.Time
+}
+
+func tarOf(t *testing.T, files ...file) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: "./" + f.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(f.content)), ModTime: f.mtime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func readAll(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b)
+	}
+}
+
+func blobs(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	filepath.WalkDir(filepath.Join(dir, "blobs"), func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	return n
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m1, err := s.ReadTar(tarOf(t, file{"a.txt", "same", t0}, file{"dir/b.txt", "same", t0}, file{"c.txt", "c1", t0}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := blobs(t, dir); n != 2 {
+		t.Errorf("%d blobs after the first state, want 2", n)
+	}
+	if m1["a.txt"].Digest != m1["dir/b.txt"].Digest {
+		t.Errorf("files with the same content have different digests")
+	}
+
+	m2, err := s.ReadTar(tarOf(t, file{"a.txt", "same", t0}, file{"c.txt", "c2", t0.Add(time.Minute)}), m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := blobs(t, dir); n != 3 {
+		t.Errorf("%d blobs after the second state, want 3", n)
+	}
+	d, err := s.PutManifest(m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := s.Manifest(d); err != nil || len(m) != 2 || m["c.txt"].Digest != m2["c.txt"].Digest {
+		t.Errorf("Manifest(%s) = %v, %v, want %v", d, m, err, m2)
+	}
+
+	// The unchanged files come from the earlier state, the others from the store.
+	local := t.TempDir()
+	os.WriteFile(filepath.Join(local, "a.txt"), []byte("same"), 0644)
+	os.Chtimes(filepath.Join(local, "a.txt"), t0, t0)
+	os.WriteFile(filepath.Join(local, "c.txt"), []byte("c1"), 0644)
+	var buf bytes.Buffer
+	if err := s.WriteTar(&buf, m2, local); err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, &buf)
+	if len(got) != 2 || got["a.txt"] != "same" || got["c.txt"] != "c2" {
+		t.Errorf("WriteTar wrote %v", got)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m1, err := s.ReadTar(tarOf(t, file{"a.txt", "a", t0}, file{"b.txt", "b1", t0}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := s.ReadTar(tarOf(t, file{"a.txt", "a", t0}, file{"b.txt", "b2", t0.Add(time.Minute)}), m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d1, _ := s.PutManifest(m1)
+	d2, _ := s.PutManifest(m2)
+	if removed, _, err := s.Sweep([]string{d2}, time.Hour); err != nil || removed != 0 {
+		t.Errorf("Sweep removed %d blobs used in the grace period, %v", removed, err)
+	}
+	removed, _, err := s.Sweep([]string{d2}, 0)
+	if err != nil || removed != 2 {
+		t.Errorf("Sweep removed %d blobs, %v, want the first manifest and b1", removed, err)
+	}
+	if s.Has(d1) || s.Has(m1["b.txt"].Digest) || !s.Has(m2["a.txt"].Digest) || !s.Has(m2["b.txt"].Digest) {
+		t.Errorf("Sweep kept the wrong blobs")
+	}
+}
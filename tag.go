@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+var tagName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// cmdTag names a snapshot of the project in the current directory, removes a
+// name, or lists them.
+func cmdTag(args []string) {
+	fs := flag.NewFlagSet("tag", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos tag [-f] <snapshot> <name>")
+		fmt.Fprintln(os.Stderr, "       cosmos tag -d <name>")
+		fmt.Fprintln(os.Stderr, "       cosmos tag")
+		fs.PrintDefaults()
+	}
+	force := fs.Bool("f", false, "move the name if another snapshot has it")
+	remove := fs.Bool("d", false, "remove the name")
+	fs.Parse(args)
+
+	workdir := M2(os.Getwd())
+	switch {
+	case fs.NArg() == 0 && !*remove:
+		tree := M2(loadState()).Project(workdir)
+		for _, s := range tree.Snapshots {
+			for _, name := range s.Tags {
+				fmt.Printf("%s %s %s\n", name, snapshot.Short(s.ID), s.Summary())
+			}
+		}
+	case fs.NArg() == 1 && *remove:
+		name := fs.Arg(0)
+		M(updateState(func(st *State) error {
+			s := st.Project(workdir).Tagged(name)
+			if s == nil {
+				return fmt.Errorf("no tag %q", name)
+			}
+			s.Tags = slices.DeleteFunc(s.Tags, func(t string) bool { return t == name })
+			return nil
+		}))
+	case fs.NArg() == 2 && !*remove:
+		id, name := fs.Arg(0), fs.Arg(1)
+		if !tagName.MatchString(name) {
+			fmt.Fprintf(os.Stderr, "invalid tag %q: letters, digits, '.', '_', '-' and '/' only\n", name)
+			os.Exit(1)
+		}
+		err := updateState(func(st *State) error {
+			tree := st.Project(workdir)
+			s, err := tree.Find(id)
+			if err != nil {
+				return err
+			}
+			if prev := tree.Tagged(name); prev != nil && prev != s {
+				if !*force {
+					return fmt.Errorf("snapshot %s is already tagged %q, -f moves the tag", snapshot.Short(prev.ID), name)
+				}
+				prev.Tags = slices.DeleteFunc(prev.Tags, func(t string) bool { return t == name })
+			}
+			if !slices.Contains(s.Tags, name) {
+				s.Tags = append(s.Tags, name)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	default:
+		fs.Usage()
+		os.Exit(1)
+	}
+}
+
+// snapshotLabels are the docker labels of the image of snap, the index-th
+// snapshot of its branch.
+func snapshotLabels(sess *session, snap *snapshot.Snapshot, index int) map[string]string {
+	return map[string]string{
+		"cosmos.project":  sess.Workdir,
+		"cosmos.session":  sess.ID,
+		"cosmos.snapshot": snap.ID,
+		"cosmos.parent":   snap.Parent,
+		"cosmos.turn":     strconv.Itoa(index),
+		"cosmos.created":  snap.Created.UTC().Format(time.RFC3339),
+		"cosmos.version":  cosmosVersion(),
+	}
+}
+
+// cosmosVersion returns the version of the cosmos binary, or the commit it was
+// built from for development builds.
+func cosmosVersion() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	version := "devel"
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			version += " " + snapshot.Short(s.Value)
+		case "vcs.modified":
+			if s.Value == "true" {
+				version += "+dirty"
+			}
+		}
+	}
+	return version
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/creack/pty"
+	"golang.org/x/term"
+)
+
+// terminal sits between the user's terminal and the agent's. It relays the agent's
+// input and output through a pseudo-terminal, and can take over the screen to
+// prompt the user without disturbing the agent's display.
+type terminal struct {
+	in, out  *os.File
+	ptm, pts *os.File // docker attach runs on pts
+	state    *term.State
+
+	mOut    sync.Mutex // held while writing the agent's output, or while prompting
+	mPrompt sync.Mutex // one prompt at a time
+	mKeys   sync.Mutex
+	keys    chan []byte // input typed during a prompt, nil otherwise
+}
+
+func newTerminal(in, out *os.File) (*terminal, error) {
+	ptm, pts, err := pty.Open()
+	if err != nil {
+		return nil, err
+	}
+	if err := pty.InheritSize(in, pts); err != nil {
+		ptm.Close()
+		pts.Close()
+		return nil, err
+	}
+	state, err := term.MakeRaw(int(in.Fd()))
+	if err != nil {
+		ptm.Close()
+		pts.Close()
+		return nil, err
+	}
+	t := &terminal{in: in, out: out, ptm: ptm, pts: pts, state: state}
+	go t.relayInput()
+	go t.relayOutput()
+	return t, nil
+}
+
+func (t *terminal) relayInput() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := t.in.Read(buf)
+		if n > 0 {
+			t.mKeys.Lock()
+			keys := t.keys
+			t.mKeys.Unlock()
+			if keys != nil {
+				select {
+				case keys <- append([]byte(nil), buf[:n]...):
+				default:
+				}
+			} else if _, err := t.ptm.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (t *terminal) relayOutput() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.ptm.Read(buf)
+		if n > 0 {
+			t.mOut.Lock()
+			t.out.Write(buf[:n])
+			t.mOut.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Resize gives the agent's terminal the size of the user's.
+func (t *terminal) Resize() {
+	pty.InheritSize(t.in, t.pts)
+}
+
+// Close gives the user's terminal back in the state it was found.
+func (t *terminal) Close() {
+	term.Restore(int(t.in.Fd()), t.state)
+	t.ptm.Close()
+	t.pts.Close()
+}
+
+// Prompt shows text on the alternate screen, so that the agent's display is
+// restored intact afterwards, and returns the line typed by the user. The agent's
+// output is held back until then.
+func (t *terminal) Prompt(ctx context.Context, text, question string) (string, error) {
+	t.mPrompt.Lock()
+	defer t.mPrompt.Unlock()
+	t.mOut.Lock()
+	defer t.mOut.Unlock()
+
+	keys := make(chan []byte, 16)
+	t.mKeys.Lock()
+	t.keys = keys
+	t.mKeys.Unlock()
+	defer func() {
+		t.mKeys.Lock()
+		t.keys = nil
+		t.mKeys.Unlock()
+	}()
+
+	// Raw mode: lines end with \r\n.
+	w := t.out
+	fmt.Fprint(w, "\x1b[?1049h\x1b[H\x1b[2J\a")
+	defer fmt.Fprint(w, "\x1b[?1049l")
+	fmt.Fprint(w, strings.ReplaceAll(strings.TrimRight(text, "\n"), "\n", "\r\n")+"\r\n\r\n"+question)
+
+	var line []rune
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case b := <-keys:
+			for _, r := range string(b) {
+				switch r {
+				case '\r', '\n':
+					return string(line), nil
+				case 3: // ^C
+					return "", io.EOF
+				case 127, 8: // backspace
+					if len(line) > 0 {
+						line = line[:len(line)-1]
+						fmt.Fprint(w, "\b \b")
+					}
+				default:
+					if r >= ' ' {
+						line = append(line, r)
+						fmt.Fprint(w, string(r))
+					}
+				}
+			}
+		}
+	}
+}
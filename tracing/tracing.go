@@ -0,0 +1,97 @@
+// Package tracing sets up OpenTelemetry trace export for the cosmos host and proxy.
+//
+// Spans are exported over OTLP/HTTP when one of the standard OTEL_EXPORTER_OTLP_*
+// endpoint variables is set, or written as JSON lines to the file named by
+// COSMOS_TRACE_FILE. When neither is set tracing is a no-op.
+package tracing
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// FileEnv is the environment variable naming the file that spans are written to
+// when no OTLP endpoint is configured.
+const FileEnv = "COSMOS_TRACE_FILE"
+
+var propagator = propagation.TraceContext{}
+
+// Enabled reports whether the environment configures a trace exporter.
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" || os.Getenv(FileEnv) != ""
+}
+
+// Init installs a global tracer provider for service and returns a function
+// flushing and stopping it. It is safe to call shutdown when tracing is disabled.
+func Init(ctx context.Context, service string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagator)
+	if !Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var f *os.File
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		exporter, err = otlptracehttp.New(ctx)
+	} else {
+		f, err = os.OpenFile(os.Getenv(FileEnv), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}, nil
+}
+
+// Inject returns the trace context of ctx in a form that can travel in a manager message.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx with the remote trace context found in carrier, as produced by Inject.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return propagator.Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// DockerEnvArgs returns the docker run arguments forwarding the OTLP exporter
+// configuration of the host environment to a container.
+func DockerEnvArgs() []string {
+	var args []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "OTEL_") {
+			args = append(args, "-e", name)
+		}
+	}
+	return args
+}
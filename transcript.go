@@ -0,0 +1,323 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"github.com/tiborvass/cosmos/store"
+	"github.com/tiborvass/cosmos/transcript"
+	. "github.com/tiborvass/cosmos/utils"
+)
+
+// cmdTranscript renders the timeline of a Claude session of the project in the
+// current directory, along with the API requests and the snapshots taken meanwhile.
+func cmdTranscript(args []string) {
+	fs := flag.NewFlagSet("transcript", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: cosmos transcript [-v] <session-id|session-log.jsonl>")
+		fs.PrintDefaults()
+	}
+	verbose := fs.Bool("v", false, "show whole texts, tool inputs and results")
+	sidechains := fs.Bool("sidechains", true, "include subagent conversations")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	workdir := M2(os.Getwd())
+	tree := M2(loadState()).Project(workdir)
+
+	var r io.Reader
+	if f, err := os.Open(fs.Arg(0)); err == nil {
+		defer f.Close()
+		r = f
+	} else {
+		b, err := sessionLogFromSnapshots(ctx, tree, workdir, fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		r = strings.NewReader(b)
+	}
+	t := M2(transcript.Parse(r))
+	for _, err := range t.Errors {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	}
+
+	// Each session has its own exchange log, older versions of cosmos shared one.
+	exchanges := map[string]*transcript.Exchange{}
+	logs := M2(filepath.Glob(filepath.Join(sessionsDir, "*", "exchanges.jsonl")))
+	for _, name := range append(logs, filepath.Join(cosmosDir, "containerlogs", "exchanges.jsonl")) {
+		if f, err := os.Open(name); err == nil {
+			maps.Copy(exchanges, M2(transcript.ReadExchanges(f)))
+			f.Close()
+		}
+	}
+
+	(&timeline{t: t, exchanges: exchanges, verbose: *verbose}).render(os.Stdout, tree, *sidechains)
+}
+
+// sessionLogFromSnapshots reads the log of the session id, or of the only session
+// starting with id, from the most recent snapshot that has it.
+func sessionLogFromSnapshots(ctx context.Context, tree *snapshot.Tree, workdir, id string) (string, error) {
+	dir := transcript.ProjectDir("/home/cosmos", workdir)
+	for i := len(tree.Snapshots) - 1; i >= 0; i-- {
+		img := tree.Snapshots[i].Image
+		if m := tree.Snapshots[i].ClaudeManifest; m != "" {
+			// Taken with the store backend, which records claude's sessions in the store.
+			log, err := sessionLogFromStore(m, strings.TrimPrefix(dir, claudeProjects+"/"), id)
+			if err != nil || log != "" {
+				return log, err
+			}
+			continue
+		}
+		if img == "" {
+			// Taken with the git backend, which saves claude's sessions next to the commit.
+			log, err := sessionLogFromClaudeState(tree.Snapshots[i].ID, strings.TrimPrefix(dir, claudeProjects+"/"), id)
+			if err != nil || log != "" {
+				return log, err
+			}
+			continue
+		}
+		out, err := exec.CommandContext(ctx, "docker", "run", "--rm", "--entrypoint", "find", img, dir, "-name", id+"*.jsonl").Output()
+		if err != nil {
+			continue
+		}
+		matches := strings.Fields(string(out))
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			return RS(ctx, []string{"docker", "run", "--rm", "--entrypoint", "cat", img, matches[0]}), nil
+		default:
+			return "", fmt.Errorf("session %q is ambiguous: %s", id, strings.Join(matches, ", "))
+		}
+	}
+	return "", fmt.Errorf("no snapshot of %s has session %q", workdir, id)
+}
+
+// sessionLogFromClaudeState reads the log of the session id of the project from
+// claude's sessions saved at a snapshot, empty if they don't have it.
+func sessionLogFromClaudeState(snapshotID, project, id string) (string, error) {
+	f, err := os.Open(claudeStatePath(snapshotID))
+	if err != nil {
+		return "", nil
+	}
+	defer f.Close()
+	var match string
+	var content []byte
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		dir, name := path.Split(path.Clean(hdr.Name))
+		if path.Clean(dir) != project || !strings.HasPrefix(name, id) || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("session %q is ambiguous: %s, %s", id, match, name)
+		}
+		match = name
+		if content, err = io.ReadAll(tr); err != nil {
+			return "", err
+		}
+	}
+	return string(content), nil
+}
+
+// sessionLogFromStore reads the log of the session id of the project from the
+// manifest of claude's sessions in the store, empty if it doesn't have it.
+func sessionLogFromStore(manifest, project, id string) (string, error) {
+	s, err := store.Open(storeDir)
+	if err != nil {
+		return "", err
+	}
+	m, err := s.Manifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	var match string
+	for p := range m {
+		dir, name := path.Split(p)
+		if path.Clean(dir) != project || !strings.HasPrefix(name, id) || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("session %q is ambiguous: %s, %s", id, path.Base(match), name)
+		}
+		match = p
+	}
+	if match == "" {
+		return "", nil
+	}
+	f, err := s.Get(m[match].Digest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
+
+type timeline struct {
+	t         *transcript.Transcript
+	exchanges map[string]*transcript.Exchange
+	verbose   bool
+
+	toolNames map[string]string // by tool_use ID
+	requests  map[string]bool   // requests already shown
+}
+
+type timelineItem struct {
+	time      time.Time
+	entry     *transcript.Entry
+	sidechain bool
+	snapshot  *snapshot.Snapshot
+}
+
+func (tl *timeline) render(w io.Writer, tree *snapshot.Tree, sidechains bool) {
+	tl.toolNames = map[string]string{}
+	tl.requests = map[string]bool{}
+	for _, e := range tl.t.Entries {
+		if e.Message == nil {
+			continue
+		}
+		for _, b := range e.Message.Content {
+			if b.Type == "tool_use" {
+				tl.toolNames[b.ID] = b.Name
+			}
+		}
+	}
+
+	thread := tl.t.Main()
+	if len(thread) == 0 {
+		fmt.Fprintln(w, "empty session")
+		return
+	}
+	var items []timelineItem
+	for _, e := range thread {
+		items = append(items, timelineItem{time: e.Timestamp, entry: e})
+	}
+	if sidechains {
+		for _, chain := range tl.t.Sidechains() {
+			for _, e := range chain {
+				items = append(items, timelineItem{time: e.Timestamp, entry: e, sidechain: true})
+			}
+		}
+	}
+	first, last := thread[0].Timestamp, thread[len(thread)-1].Timestamp
+	for _, s := range tree.Snapshots {
+		if !s.Created.Before(first) && !s.Created.After(last.Add(time.Minute)) {
+			items = append(items, timelineItem{time: s.Created, snapshot: s})
+		}
+	}
+	slices.SortStableFunc(items, func(a, b timelineItem) int { return a.time.Compare(b.time) })
+
+	fmt.Fprintf(w, "Session %s, %s to %s\n", thread[0].SessionID, first.Local().Format(time.DateTime), last.Local().Format(time.DateTime))
+	if summary, ok := tl.t.Summaries()[thread[len(thread)-1].UUID]; ok {
+		fmt.Fprintf(w, "Summary: %s\n", summary)
+	}
+	fmt.Fprintln(w)
+	for _, it := range items {
+		prefix := it.time.Local().Format(time.TimeOnly) + " "
+		if it.sidechain {
+			prefix += "  ⤷ "
+		}
+		if it.snapshot != nil {
+			fmt.Fprintf(w, "%s● snapshot %s %s\n", prefix, snapshot.Short(it.snapshot.ID), it.snapshot.Summary())
+			continue
+		}
+		tl.renderEntry(w, prefix, it.entry)
+	}
+}
+
+func (tl *timeline) text(s string) string {
+	if tl.verbose {
+		return strings.TrimSpace(s)
+	}
+	return snapshot.Excerpt(s, 100)
+}
+
+func (tl *timeline) renderEntry(w io.Writer, prefix string, e *transcript.Entry) {
+	indent := strings.Repeat(" ", len([]rune(prefix))+11)
+	line := func(kind, text string) {
+		fmt.Fprintf(w, "%s%-10s %s\n", prefix, kind, strings.ReplaceAll(text, "\n", "\n"+indent))
+		prefix = strings.Repeat(" ", len([]rune(prefix)))
+	}
+
+	switch {
+	case e.Type == "system":
+		line("system", tl.text(e.Content))
+		return
+	case e.Message == nil || e.IsMeta:
+		return
+	}
+	if e.IsAPIErrorMessage {
+		line("api error", tl.text(e.Message.Content.Text()))
+		return
+	}
+	for _, b := range e.Message.Content {
+		switch b.Type {
+		case "text":
+			line(e.Message.Role, tl.text(b.Text))
+		case "thinking":
+			line("thinking", tl.text(b.Thinking))
+		case "tool_use":
+			c := snapshot.NewToolCall(b.Name, b.Input)
+			if tl.verbose {
+				c.Input = string(b.Input)
+			}
+			line("tool", c.String())
+		case "tool_result":
+			status := "result"
+			if b.IsError {
+				status = "error"
+			}
+			line(status, tl.toolNames[b.ToolUseID]+": "+tl.result(b.Content))
+		case "image":
+			line(e.Message.Role, image(b))
+		}
+	}
+	if x, ok := tl.exchanges[e.RequestID]; ok && !tl.requests[e.RequestID] {
+		tl.requests[e.RequestID] = true
+		line("request", fmt.Sprintf("%s %d %s %s, %d in, %d out, %d cache read", x.RequestID, x.Status, x.Duration.Round(time.Millisecond), x.StopReason, x.Usage.InputTokens, x.Usage.OutputTokens, x.Usage.CacheReadInputTokens))
+	}
+}
+
+func (tl *timeline) result(c transcript.Content) string {
+	var parts []string
+	for _, b := range c {
+		switch b.Type {
+		case "text":
+			parts = append(parts, b.Text)
+		case "image":
+			parts = append(parts, image(b))
+		}
+	}
+	return tl.text(strings.Join(parts, "\n"))
+}
+
+func image(b transcript.Block) string {
+	if b.Source == nil {
+		return "[image]"
+	}
+	return fmt.Sprintf("[image %s, %d bytes]", b.Source.MediaType, len(b.Source.Data)*3/4)
+}
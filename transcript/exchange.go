@@ -0,0 +1,34 @@
+package transcript
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Exchange is an API request seen by the proxy. The proxy appends one per line to
+// its exchange log, and RequestID matches the requestId of the assistant entries
+// produced by the request.
+type Exchange struct {
+	Time       time.Time
+	RequestID  string
+	Status     int
+	Model      string `json:",omitempty"`
+	StopReason string `json:",omitempty"`
+	Usage      Usage
+	Duration   time.Duration
+}
+
+// ReadExchanges reads an exchange log, skipping malformed lines.
+func ReadExchanges(r io.Reader) (map[string]*Exchange, error) {
+	out := map[string]*Exchange{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		var x Exchange
+		if json.Unmarshal(s.Bytes(), &x) == nil && x.RequestID != "" {
+			out[x.RequestID] = &x
+		}
+	}
+	return out, s.Err()
+}
@@ -0,0 +1,276 @@
+// Package transcript parses the session logs Claude writes to
+// ~/.claude/projects/<project>/<session>.jsonl.
+//
+// Every line is an entry pointing to its parent, so the log is a tree: going
+// back in the conversation starts a new branch, and subagents run in sidechains
+// hanging off the main conversation.
+package transcript
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var nonAlnum = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// ProjectDir returns the directory where Claude writes the session logs of the project in dir.
+func ProjectDir(home, dir string) string {
+	return filepath.Join(home, ".claude", "projects", nonAlnum.ReplaceAllString(dir, "-"))
+}
+
+// Entry is a line of a session log.
+type Entry struct {
+	Type        string    `json:"type"` // user, assistant, system or summary
+	UUID        string    `json:"uuid"`
+	ParentUUID  string    `json:"parentUuid"`
+	IsSidechain bool      `json:"isSidechain"`
+	IsMeta      bool      `json:"isMeta"`
+	SessionID   string    `json:"sessionId"`
+	Timestamp   time.Time `json:"timestamp"`
+	Cwd         string    `json:"cwd"`
+	Version     string    `json:"version"`
+	GitBranch   string    `json:"gitBranch"`
+	RequestID   string    `json:"requestId"` // API request that produced an assistant entry
+
+	Message *Message `json:"message"`
+
+	// ToolUseResult is the structured result of the tool, alongside the tool_result block sent to the model.
+	ToolUseResult json.RawMessage `json:"toolUseResult"`
+
+	// IsAPIErrorMessage marks assistant entries made up by Claude to report a failed API request.
+	IsAPIErrorMessage bool `json:"isApiErrorMessage"`
+
+	// Content and Level are set on system entries.
+	Content string `json:"content"`
+	Level   string `json:"level"`
+
+	// Summary and LeafUUID are set on summary entries, describing the conversation ending at LeafUUID.
+	Summary  string `json:"summary"`
+	LeafUUID string `json:"leafUuid"`
+
+	// Line is the line number of the entry in the log.
+	Line int `json:"-"`
+}
+
+// Message is the API message of a user or assistant entry.
+type Message struct {
+	ID         string  `json:"id"`
+	Role       string  `json:"role"`
+	Model      string  `json:"model"`
+	Content    Content `json:"content"`
+	StopReason string  `json:"stop_reason"`
+	Usage      *Usage  `json:"usage"`
+}
+
+// Content is a list of content blocks. A plain string is read as a single text
+// block. Blocks are decoded one at a time, the malformed ones are skipped rather
+// than losing the others.
+type Content []Block
+
+func (c *Content) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*c = Content{{Type: "text", Text: s}}
+		return nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	blocks := make(Content, 0, len(raw))
+	for _, r := range raw {
+		var block Block
+		if json.Unmarshal(r, &block) != nil || block.Type == "" {
+			continue
+		}
+		blocks = append(blocks, block)
+	}
+	*c = blocks
+	return nil
+}
+
+// Block is a content block. Which fields are set depends on Type.
+type Block struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// thinking
+	Thinking string `json:"thinking,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string  `json:"tool_use_id,omitempty"`
+	Content   Content `json:"content,omitempty"`
+	IsError   bool    `json:"is_error,omitempty"`
+
+	// image
+	Source *ImageSource `json:"source,omitempty"`
+}
+
+// ImageSource is the data of an image block.
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// Usage is the number of tokens used by the API request of an assistant entry.
+type Usage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// Text returns the concatenated text blocks of c.
+func (c Content) Text() string {
+	var sb bytes.Buffer
+	for _, b := range c {
+		if b.Type == "text" {
+			if sb.Len() > 0 {
+				sb.WriteByte('\n')
+			}
+			sb.WriteString(b.Text)
+		}
+	}
+	return sb.String()
+}
+
+// LineError is a line of the log that could not be parsed.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Transcript is a parsed session log.
+type Transcript struct {
+	Entries []*Entry
+	// Errors are the lines that could not be parsed, the rest of the log is still read.
+	Errors []*LineError
+
+	byUUID map[string]*Entry
+}
+
+// Parse reads a session log. Only read errors are returned, malformed lines are
+// recorded in Errors.
+func Parse(r io.Reader) (*Transcript, error) {
+	t := &Transcript{byUUID: map[string]*Entry{}}
+	br := bufio.NewReader(r)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e := &Entry{Line: lineNo}
+			if err := json.Unmarshal(line, e); err != nil {
+				t.Errors = append(t.Errors, &LineError{Line: lineNo, Err: err})
+			} else {
+				t.Entries = append(t.Entries, e)
+				if e.UUID != "" {
+					t.byUUID[e.UUID] = e
+				}
+			}
+		}
+		if err == io.EOF {
+			return t, nil
+		} else if err != nil {
+			return t, err
+		}
+	}
+}
+
+// Get returns the entry with the given UUID, or nil.
+func (t *Transcript) Get(uuid string) *Entry {
+	return t.byUUID[uuid]
+}
+
+// Thread returns the entries from the root of the conversation down to leaf.
+func (t *Transcript) Thread(leaf string) []*Entry {
+	var out []*Entry
+	seen := map[string]bool{}
+	for e := t.Get(leaf); e != nil && !seen[e.UUID]; e = t.Get(e.ParentUUID) {
+		seen[e.UUID] = true
+		out = append(out, e)
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// Main returns the current branch of the main conversation: the thread of the
+// last entry that is not in a sidechain.
+func (t *Transcript) Main() []*Entry {
+	for i := len(t.Entries) - 1; i >= 0; i-- {
+		if e := t.Entries[i]; e.UUID != "" && !e.IsSidechain {
+			return t.Thread(e.UUID)
+		}
+	}
+	return nil
+}
+
+// Sidechains returns the subagent conversations, each one in the order it was logged.
+func (t *Transcript) Sidechains() [][]*Entry {
+	var chains [][]*Entry
+	index := map[string]int{} // UUID to the sidechain it belongs to
+	for _, e := range t.Entries {
+		if !e.IsSidechain || e.UUID == "" {
+			continue
+		}
+		i, ok := index[e.ParentUUID]
+		if !ok {
+			i = len(chains)
+			chains = append(chains, nil)
+		}
+		chains[i] = append(chains[i], e)
+		index[e.UUID] = i
+	}
+	return chains
+}
+
+// Summaries returns the summaries of the conversation, by leaf UUID.
+func (t *Transcript) Summaries() map[string]string {
+	out := map[string]string{}
+	for _, e := range t.Entries {
+		if e.Type == "summary" {
+			out[e.LeafUUID] = e.Summary
+		}
+	}
+	return out
+}
+
+// ToolUse returns the tool_use block with the given ID and the entry containing it.
+func (t *Transcript) ToolUse(id string) (*Entry, *Block) {
+	for _, e := range t.Entries {
+		if e.Message == nil {
+			continue
+		}
+		for i, b := range e.Message.Content {
+			if b.Type == "tool_use" && b.ID == id {
+				return e, &e.Message.Content[i]
+			}
+		}
+	}
+	return nil, nil
+}
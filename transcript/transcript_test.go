@@ -0,0 +1,72 @@
+package transcript
+
+import (
+	"strings"
+	"testing"
+)
+
+const sessionLog = `{"type":"summary","summary":"Fix the tests","leafUuid":"a2"}
+{"type":"user","uuid":"u1","parentUuid":null,"sessionId":"s","timestamp":"2025-06-03T21:48:00Z","message":{"role":"user","content":"fix the tests"}}
+{"type":"assistant","uuid":"a1","parentUuid":"u1","sessionId":"s","requestId":"req_1","timestamp":"2025-06-03T21:48:01Z","message":{"id":"msg_1","role":"assistant","model":"claude","content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"/w/x_test.go"}}],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5}}}
+{"type":"user","uuid":"r1","parentUuid":"a1","sessionId":"s","timestamp":"2025-06-03T21:48:02Z","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","is_error":true,"content":[{"type":"text","text":"no such file"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}]},"toolUseResult":"Error: no such file"}
+{"type":"user","uuid":"t1","parentUuid":null,"isSidechain":true,"sessionId":"s","timestamp":"2025-06-03T21:48:03Z","message":{"role":"user","content":"find the tests"}}
+{"type":"assistant","uuid":"t2","parentUuid":"t1","isSidechain":true,"sessionId":"s","timestamp":"2025-06-03T21:48:04Z","message":{"role":"assistant","content":[{"type":"text","text":"in x_test.go"}]}}
+not json
+{"type":"assistant","uuid":"a2","parentUuid":"r1","sessionId":"s","timestamp":"2025-06-03T21:48:05Z","message":{"role":"assistant","content":[{"type":"text","text":"done"}]}}
+{"type":"assistant","uuid":"b1","parentUuid":"u1","sessionId":"s","timestamp":"2025-06-03T21:48:06Z","message":{"role":"assistant","content":[{"type":"text","text":"other branch"}]}}
+`
+
+func TestParse(t *testing.T) {
+	tr, err := Parse(strings.NewReader(sessionLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.Entries) != 8 {
+		t.Errorf("got %d entries, want 8", len(tr.Entries))
+	}
+	if len(tr.Errors) != 1 || tr.Errors[0].Line != 7 {
+		t.Errorf("got errors %v, want line 7", tr.Errors)
+	}
+
+	u1 := tr.Get("u1")
+	if u1 == nil || u1.Message.Content.Text() != "fix the tests" {
+		t.Fatalf("string content not read as text: %+v", u1)
+	}
+	if a1 := tr.Get("a1"); a1.RequestID != "req_1" || a1.Message.Usage.InputTokens != 10 || string(a1.Message.Content[0].Input) != `{"file_path":"/w/x_test.go"}` {
+		t.Errorf("unexpected assistant entry %+v", a1.Message)
+	}
+	res := tr.Get("r1").Message.Content[0]
+	if !res.IsError || res.Content.Text() != "no such file" || res.Content[1].Source.MediaType != "image/png" {
+		t.Errorf("unexpected tool result %+v", res)
+	}
+	if e, b := tr.ToolUse("toolu_1"); e != tr.Get("a1") || b.Name != "Read" {
+		t.Errorf("ToolUse returned %v, %v", e, b)
+	}
+	if got := tr.Summaries()["a2"]; got != "Fix the tests" {
+		t.Errorf("got summary %q", got)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	tr, err := Parse(strings.NewReader(sessionLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := func(entries []*Entry) string {
+		var s []string
+		for _, e := range entries {
+			s = append(s, e.UUID)
+		}
+		return strings.Join(s, " ")
+	}
+	if got := uuids(tr.Main()); got != "u1 b1" {
+		t.Errorf("Main() = %s, want the last branch", got)
+	}
+	if got := uuids(tr.Thread("a2")); got != "u1 a1 r1 a2" {
+		t.Errorf("Thread(a2) = %s", got)
+	}
+	chains := tr.Sidechains()
+	if len(chains) != 1 || uuids(chains[0]) != "t1 t2" {
+		t.Errorf("unexpected sidechains %v", chains)
+	}
+}
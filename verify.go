@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/tiborvass/cosmos/snapshot"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// verifyTimeout is how long the verification command runs before it is stopped.
+const verifyTimeout = 10 * time.Minute
+
+// verifying keeps the verifications of successive snapshots from running at once.
+var verifying sync.Mutex
+
+// verifyInImage reports whether the image of a snapshot holds the workdir, so that
+// the verification can run in a container of its own while the agent goes on.
+func verifyInImage(snap *snapshot.Snapshot) bool {
+	return opts.SnapshotBackend == backendDocker && opts.Mount == mountCopy && snap.Image != ""
+}
+
+// verifySnapshot runs the verification command on the workdir of snap in the
+// container of the session, which must not change it meanwhile, and sets
+// snap.Verify. It is for the snapshots verifyInImage can't run from their image.
+func verifySnapshot(ctx context.Context, sess *session, snap *snapshot.Snapshot) {
+	args := append([]string{"exec", "-u", "cosmos", "-w", sess.Workdir, sess.Container, "timeout"}, timeoutArgs(verifyTimeout)...)
+	v, err := verify(ctx, snap.ID, "docker", append(args, "sh", "-c", opts.Verify)...)
+	if err != nil {
+		fmt.Fprintln(logFile, "verify", snap.ID, ":", err)
+		return
+	}
+	snap.Verify = v
+}
+
+// verifyImage runs the verification command in a throwaway container of the image
+// of snap, and records its result in the snapshot once done.
+func verifyImage(ctx context.Context, sess *session, snap *snapshot.Snapshot) {
+	verifying.Lock()
+	defer verifying.Unlock()
+	v, err := verify(ctx, snap.ID, "sh", "-c", throwawayRun(snap.Image, sess.Workdir, verifyTimeout), "sh", opts.Verify)
+	if err == nil {
+		err = updateState(func(st *State) error {
+			if s := st.Project(sess.Workdir).Get(snap.ID); s != nil {
+				s.Verify = v
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(logFile, "verify", snap.ID, ":", err)
+	}
+}
+
+// verify runs the verification of the snapshot id with name and args, and returns
+// its outcome. The error is for docker failing, not the command.
+func verify(ctx context.Context, id, name string, args ...string) (*snapshot.Verification, error) {
+	ctx, span := tracer.Start(ctx, "verify", trace.WithAttributes(attribute.String("snapshot", id)))
+	defer span.End()
+
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	v := &snapshot.Verification{Command: opts.Verify, Duration: time.Since(start)}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr) && timedOut(exitErr.ExitCode()):
+		v.ExitCode = -1
+		out = fmt.Appendf(out, "\ncosmos: stopped after %v\n", verifyTimeout)
+	case errors.As(err, &exitErr):
+		v.ExitCode = exitErr.ExitCode()
+	case err != nil:
+		return nil, fmt.Errorf("%w: %s", err, out)
+	}
+	v.Output = snapshot.Tail(string(out), 4096)
+	span.SetAttributes(attribute.Int("exit_code", v.ExitCode))
+	fmt.Fprintln(logFile, "verify", id, v, "in", v.Duration)
+	return v, nil
+}
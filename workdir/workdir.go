@@ -0,0 +1,344 @@
+// Package workdir snapshots a directory shared with the container, which docker
+// commit doesn't capture, as archives of the files changed between snapshots.
+//
+// A manifest lists the state of every file at a snapshot. Restoring one extracts
+// the archives of the snapshots leading to it, oldest first, then the files still
+// differing from it from the archives of what the directory held before the first
+// snapshot, and removes the files created since that its manifest doesn't have.
+package workdir
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// FileState is what tells whether a file changed.
+type FileState struct {
+	Size    int64
+	ModTime time.Time
+	Mode    fs.FileMode
+	Link    string `json:",omitempty"` // target of a symbolic link
+	// Digest identifies the content of a regular file, for the manifests of a
+	// content-addressed store. Scan leaves it empty.
+	Digest string `json:",omitempty"`
+}
+
+// Same reports whether a file in state st has the content of one in state x, going
+// by its size, modification time and mode, or its target for a link.
+func (st FileState) Same(x FileState) bool {
+	return st.Mode == x.Mode && st.Size == x.Size && st.ModTime.Equal(x.ModTime) && st.Link == x.Link
+}
+
+// InfoState returns the state of a regular file or symbolic link from its info.
+// The target of a link is left to the caller.
+func InfoState(info fs.FileInfo) FileState {
+	if info.Mode()&fs.ModeSymlink != 0 {
+		// Links are compared by target, their time isn't restored.
+		return FileState{Mode: info.Mode()}
+	}
+	return FileState{Size: info.Size(), ModTime: info.ModTime().Truncate(time.Second), Mode: info.Mode()}
+}
+
+// HeaderState returns the state of the file of a tar entry, and false if it is
+// neither a regular file nor a symbolic link.
+func HeaderState(hdr *tar.Header) (FileState, bool) {
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		return FileState{Size: hdr.Size, ModTime: hdr.ModTime.Truncate(time.Second), Mode: hdr.FileInfo().Mode()}, true
+	case tar.TypeSymlink:
+		return FileState{Mode: hdr.FileInfo().Mode(), Link: hdr.Linkname}, true
+	}
+	// Directories are implied, sockets, pipes and devices can't be archived.
+	return FileState{}, false
+}
+
+// Manifest is the state of the files under a directory, by slash-separated path
+// relative to it. Directories are implied by the files they contain.
+type Manifest map[string]FileState
+
+// Scan returns the manifest of the files under root.
+func Scan(root string) (Manifest, error) {
+	m := Manifest{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		st := InfoState(info)
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if st.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case !info.Mode().IsRegular():
+			// Sockets, pipes and devices can't be archived.
+			return nil
+		}
+		m[filepath.ToSlash(rel)] = st
+		return nil
+	})
+	return m, err
+}
+
+// Changed returns the paths of cur that are not in old or differ from it, sorted.
+func Changed(old, cur Manifest) []string {
+	var paths []string
+	for p, st := range cur {
+		if prev, ok := old[p]; !ok || !prev.Same(st) {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// WriteArchive writes the files at paths under root to w as a gzipped tar.
+func WriteArchive(w io.Writer, root string, paths []string) error {
+	gz := gzip.NewWriter(w)
+	if err := WriteTar(gz, root, paths); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// WriteArchiveFrom writes the files at paths, as m has them, to w as a gzipped
+// tar, with the content open returns for them.
+func WriteArchiveFrom(w io.Writer, m Manifest, paths []string, open func(p string) ([]byte, error)) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, p := range paths {
+		st := m[p]
+		hdr := &tar.Header{Name: p, Mode: int64(st.Mode.Perm()), ModTime: st.ModTime}
+		var b []byte
+		if st.Mode&fs.ModeSymlink != 0 {
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, st.Link
+		} else {
+			var err error
+			if b, err = open(p); err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			hdr.Typeflag, hdr.Size = tar.TypeReg, int64(len(b))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// WriteTar writes the files and directories at paths under root to w as a tar.
+func WriteTar(w io.Writer, root string, paths []string) error {
+	tw := tar.NewWriter(w)
+	for _, p := range paths {
+		if err := addFile(tw, root, p); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addFile(tw *tar.Writer, root, p string) error {
+	path := filepath.Join(root, filepath.FromSlash(p))
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Removed since it was scanned, the manifest of the next snapshot won't have it.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var link string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = p
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// ExtractArchive extracts an archive written by WriteArchive under root.
+func ExtractArchive(r io.Reader, root string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	return ExtractTar(gz, root)
+}
+
+// ExtractTar extracts the files and symbolic links of a tar under root, creating
+// their directories as needed.
+func ExtractTar(r io.Reader, root string) error {
+	return extractTar(r, root, nil)
+}
+
+func extractTar(r io.Reader, root string, want func(string) bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return fmt.Errorf("archive entry %q is outside of the directory", hdr.Name)
+		}
+		if want != nil && !want(hdr.Name) {
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(hdr.Name))
+		if hdr.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if err := errors.Join(err, f.Close()); err != nil {
+				return err
+			}
+			// Without the umask.
+			if err := os.Chmod(path, hdr.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+}
+
+// Restore brings root back to target, extracting the archives of the snapshots
+// leading to it, oldest first, then the files that are still not as target has
+// them from baseArchives, which hold files of root as it was in base. Of the
+// files target doesn't have, it only removes those created since base that
+// created has, and returns the others as kept. It also returns the paths that
+// still differ from target.
+func Restore(root string, base Manifest, baseArchives []string, archives []string, target, created Manifest) (kept, differ []string, err error) {
+	for _, name := range archives {
+		if err := extractFile(name, root, nil); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	cur, err := Scan(root)
+	if err != nil {
+		return nil, nil, err
+	}
+	fromBase := map[string]bool{}
+	for p, st := range target {
+		if !cur[p].Same(st) && base[p].Same(st) {
+			fromBase[p] = true
+		}
+	}
+	if len(fromBase) > 0 {
+		for _, name := range baseArchives {
+			if err := extractFile(name, root, func(p string) bool { return fromBase[p] }); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		if cur, err = Scan(root); err != nil {
+			return nil, nil, err
+		}
+	}
+	for p := range cur {
+		if _, ok := target[p]; ok {
+			continue
+		}
+		_, inBase := base[p]
+		if _, ok := created[p]; !ok || inBase {
+			// Not created by the agent as far as the snapshots tell.
+			kept = append(kept, p)
+			continue
+		}
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(p))); err != nil {
+			return nil, nil, err
+		}
+		delete(cur, p)
+	}
+	for _, p := range kept {
+		delete(cur, p)
+	}
+	differ = Changed(target, cur)
+	for p := range target {
+		if _, ok := cur[p]; !ok {
+			differ = append(differ, p)
+		}
+	}
+	slices.Sort(kept)
+	slices.Sort(differ)
+	return kept, differ, nil
+}
+
+// extractFile extracts the archive name under root, only the paths for which
+// want returns true if it is not nil.
+func extractFile(name, root string, want func(string) bool) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	return extractTar(gz, root, want)
+}
@@ -0,0 +1,141 @@
+package workdir
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, root, p, content string, mtime time.Time) {
+	t.Helper()
+	path := filepath.Join(root, p)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func scan(t *testing.T, root string) Manifest {
+	t.Helper()
+	m, err := Scan(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// snapshot archives the files changed since prev and returns the archive and the manifest.
+func snapshot(t *testing.T, root string, prev Manifest) (string, Manifest) {
+	t.Helper()
+	cur := scan(t, root)
+	f, err := os.CreateTemp(t.TempDir(), "*.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := WriteArchive(f, root, Changed(prev, cur)); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name(), cur
+}
+
+func TestRestore(t *testing.T) {
+	root := t.TempDir()
+	t0 := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write(t, root, "a.txt", "a0", t0)
+	write(t, root, "dir/b.txt", "b0", t0)
+	base := scan(t, root)
+	// b.txt archived as the session starts, a.txt later from another copy of it.
+	eager, err := os.CreateTemp(t.TempDir(), "*.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eager.Close()
+	if err := WriteArchive(eager, root, []string{"dir/b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := os.CreateTemp(t.TempDir(), "*.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	if err := WriteArchiveFrom(lazy, base, []string{"a.txt"}, func(p string) ([]byte, error) { return []byte("a0"), nil }); err != nil {
+		t.Fatal(err)
+	}
+	baseArchives := []string{eager.Name(), lazy.Name()}
+
+	write(t, root, "a.txt", "a1", t0.Add(time.Minute))
+	write(t, root, "dir/c.txt", "c1", t0.Add(time.Minute))
+	if err := os.Symlink("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	arch1, m1 := snapshot(t, root, base)
+	if got, want := Changed(base, m1), []string{"a.txt", "dir/c.txt", "link"}; !slices.Equal(got, want) {
+		t.Errorf("changed: got %v, want %v", got, want)
+	}
+
+	write(t, root, "a.txt", "a2", t0.Add(2*time.Minute))
+	write(t, root, "dir/b.txt", "b2", t0.Add(2*time.Minute))
+	os.Remove(filepath.Join(root, "dir/c.txt"))
+	write(t, root, "d.txt", "d2", t0.Add(2*time.Minute))
+	arch2, m2 := snapshot(t, root, m1)
+	// What the snapshots of the session recorded.
+	created := Manifest{}
+	maps.Copy(created, m1)
+	maps.Copy(created, m2)
+	// Created on the host after the last snapshot, by the user as far as cosmos knows.
+	write(t, root, "e.txt", "e", t0.Add(3*time.Minute))
+
+	// Back to the first snapshot, b.txt was first changed after it.
+	kept, differ, err := Restore(root, base, baseArchives, []string{arch1}, m1, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(differ) > 0 {
+		t.Errorf("differ: got %v", differ)
+	}
+	if want := []string{"e.txt"}; !slices.Equal(kept, want) {
+		t.Errorf("kept: got %v, want %v", kept, want)
+	}
+	for p, want := range map[string]string{"a.txt": "a1", "dir/b.txt": "b0", "dir/c.txt": "c1", "link": "a1", "e.txt": "e"} {
+		if b, err := os.ReadFile(filepath.Join(root, p)); err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", p, b, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "d.txt")); err == nil {
+		t.Error("d.txt was not removed")
+	}
+
+	// And forward to the second.
+	_, differ, err = Restore(root, base, baseArchives, []string{arch1, arch2}, m2, created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(differ) > 0 {
+		t.Errorf("differ: got %v", differ)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "dir/b.txt")); string(b) != "b2" {
+		t.Errorf("dir/b.txt: got %q", b)
+	}
+
+	// And back to before the first snapshot.
+	if _, differ, err = Restore(root, base, baseArchives, nil, base, created); err != nil {
+		t.Fatal(err)
+	}
+	if len(differ) > 0 {
+		t.Errorf("differ: got %v", differ)
+	}
+	for p, want := range map[string]string{"a.txt": "a0", "dir/b.txt": "b0"} {
+		if b, err := os.ReadFile(filepath.Join(root, p)); err != nil || string(b) != want {
+			t.Errorf("%s: got %q, %v, want %q", p, b, err, want)
+		}
+	}
+}